@@ -6,7 +6,9 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
+	"slices"
 
+	"github.com/bensku/dove/nameserver"
 	"github.com/bensku/dove/zone"
 	"github.com/miekg/dns"
 )
@@ -20,10 +22,31 @@ type acmeResponse struct {
 	Txt string `json:"txt"`
 }
 
+// Records and config of a zone
+type zoneResponse struct {
+	Config  zone.ZoneConfig `json:"config"`
+	Records []recordWithId  `json:"records"`
+}
+
+type statusResponse struct {
+	Zones []zone.ZoneStatus `json:"zones"`
+}
+
 func New(ctx context.Context, addr string,
-	storage zone.ZoneStorage, apiKeys []string) {
+	storage zone.ZoneStorage, zones *zone.ZoneServer, queryLog *nameserver.QueryLog, apiKeys []string) {
 	mux := http.NewServeMux()
 
+	// Status of zones served by this node
+	mux.HandleFunc("GET /api/v1/status", func(w http.ResponseWriter, r *http.Request) {
+		data, err := json.Marshal(statusResponse{Zones: zones.Status()})
+		if err != nil {
+			slog.Error("failed to serialize status: %v", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+	})
+
 	// Zone listing
 	mux.HandleFunc("GET /api/v1/zone", func(w http.ResponseWriter, r *http.Request) {
 		zones, err := storage.ListZones(r.Context())
@@ -41,23 +64,219 @@ func New(ctx context.Context, addr string,
 		w.Write(data)
 	})
 
-	// TODO zone GET to list all records
+	// Query log settings
+	mux.HandleFunc("GET /api/v1/querylog", func(w http.ResponseWriter, r *http.Request) {
+		data, err := json.Marshal(queryLog.Config())
+		if err != nil {
+			slog.Error("failed to serialize query log config: %v", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+	})
+	mux.HandleFunc("PUT /api/v1/querylog", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			slog.Error("failed to read request body: %v", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var config nameserver.QueryLogConfig
+		err = json.Unmarshal(body, &config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = queryLog.SetConfig(config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		slog.Info("query log config changed", "level", config.Level, "sampleRate", config.SampleRate, "zones", config.Zones)
+	})
+
+	// Zone content, with zone version as ETag
+	mux.HandleFunc("GET /api/v1/zone/{zone}", func(w http.ResponseWriter, r *http.Request) {
+		data, err := storage.Load(r.Context(), r.PathValue("zone"))
+		if err != nil {
+			slog.Error("failed to load zone: %v", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response := zoneResponse{Config: data.Config, Records: make([]recordWithId, len(data.Records))}
+		for i, record := range data.Records {
+			response.Records[i] = newRecordWithId(record)
+		}
+		body, err := json.Marshal(response)
+		if err != nil {
+			slog.Error("failed to serialize zone: %v", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		setVersion(w, data.UpdatedHash)
+		w.Write(body)
+	})
 
 	// Zone manipulation
 	mux.HandleFunc("PUT /api/v1/zone/{zone}", func(w http.ResponseWriter, r *http.Request) {
 		name := r.PathValue("zone")
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			slog.Error("failed to read request body: %v", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		storage.AddZone(r.Context(), name)
+		if len(body) == 0 {
+			return // No config given
+		}
+
+		var config zone.ZoneConfig
+		err = json.Unmarshal(body, &config)
+		if err == nil {
+			err = config.Validate()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Zones synced from zone files stay synced when their config changes
+		existing, err := storage.Load(r.Context(), name)
+		if err != nil {
+			slog.Error("failed to load zone: %v", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		config.Synced = config.Synced || existing.Config.Synced
+
+		if version := requiredVersion(r); version != "" {
+			applyChanges(w, r, storage, name, zone.Changeset{Config: &config, Version: version})
+			return
+		}
+		err = storage.SetConfig(r.Context(), name, config)
+		if err != nil {
+			slog.Error("failed to set zone config: %v", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 	})
 	mux.HandleFunc("DELETE /api/v1/zone/{zone}", func(w http.ResponseWriter, r *http.Request) {
 		name := r.PathValue("zone")
-		storage.Clear(r.Context(), name)      // Clear zone content
+		if version := requiredVersion(r); version != "" {
+			// Clear zone content only if it has not changed
+			changes := zone.Changeset{Clear: true, Version: version}
+			if !applyChanges(w, r, storage, name, changes) {
+				return
+			}
+		} else {
+			storage.Clear(r.Context(), name) // Clear zone content
+		}
 		storage.DeleteZone(r.Context(), name) // Delete zone for good
 	})
 
+	// Zone files
+	mux.HandleFunc("GET /api/v1/zone/{zone}/export", func(w http.ResponseWriter, r *http.Request) {
+		zoneId := r.PathValue("zone")
+		data, err := storage.Load(r.Context(), zoneId)
+		if err != nil {
+			slog.Error("failed to load zone: %v", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/dns")
+		setVersion(w, data.UpdatedHash)
+		zone.WriteZoneFile(w, zoneId, data.Records)
+	})
+	mux.HandleFunc("POST /api/v1/zone/{zone}/import", func(w http.ResponseWriter, r *http.Request) {
+		zoneId := r.PathValue("zone")
+		mode := r.URL.Query().Get("mode")
+		if mode == "" {
+			mode = importMerge
+		}
+		if mode != importMerge && mode != importReplace {
+			http.Error(w, "mode must be merge or replace", http.StatusBadRequest)
+			return
+		}
+		records, err := zone.ParseZoneFile(r.Body, zoneId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		existing, err := storage.Load(r.Context(), zoneId)
+		if err != nil {
+			slog.Error("failed to load zone: %v", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Everything is changed at once, and zone gets a new version
+		changes := importChanges(mode, existing.Records, records)
+		changes.Staged = true // Zones can have more records than etcd writes at once
+		changes.Version = requiredVersion(r)
+		if changes.Version == "" && len(changes.Delete) != 0 {
+			// Records deleted are based on what zone had when it was loaded
+			changes.Version = existing.UpdatedHash
+		}
+		storage.AddZone(r.Context(), zoneId)
+		if !applyChanges(w, r, storage, zoneId, changes) {
+			return
+		}
+		slog.Info("imported zone", "zone", zoneId, "mode", mode, "records", len(records))
+	})
+
+	// Atomic changes to many records
+	mux.HandleFunc("POST /api/v1/zone/{zone}/changes", func(w http.ResponseWriter, r *http.Request) {
+		zoneId := r.PathValue("zone")
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			slog.Error("failed to read request body: %v", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		changes, err := parseChanges(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		changes.Version = requiredVersion(r)
+		applyChanges(w, r, storage, zoneId, changes)
+	})
+
 	// DNS record manipulation
+	mux.HandleFunc("GET /api/v1/zone/{zone}/{record}", func(w http.ResponseWriter, r *http.Request) {
+		recordId := r.PathValue("record")
+		data, err := storage.Load(r.Context(), r.PathValue("zone"))
+		if err != nil {
+			slog.Error("failed to load zone: %v", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		i := slices.IndexFunc(data.Records, func(record zone.DnsRecord) bool {
+			return record.Id == recordId
+		})
+		if i == -1 {
+			http.Error(w, "record not found", http.StatusNotFound)
+			return
+		}
+		body, err := json.Marshal(newRecordWithId(data.Records[i]))
+		if err != nil {
+			slog.Error("failed to serialize record: %v", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		setVersion(w, data.UpdatedHash)
+		w.Write(body)
+	})
 	mux.HandleFunc("PUT /api/v1/zone/{zone}/{record}", func(w http.ResponseWriter, r *http.Request) {
 		zoneId := r.PathValue("zone")
 		recordId := r.PathValue("record")
+		err := validateRecordId(recordId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
@@ -65,17 +284,19 @@ func New(ctx context.Context, addr string,
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		record, err := dns.NewRR(string(body))
+		record, err := parseRecord(r.Header.Get("Content-Type"), body)
 		if err != nil {
 			slog.Error("failed to parse record: %v", "error", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		record.Id = recordId
 
-		err = storage.Patch(r.Context(), zoneId, zone.DnsRecord{
-			Id:     recordId,
-			Record: record,
-		})
+		if version := requiredVersion(r); version != "" {
+			applyChanges(w, r, storage, zoneId, zone.Changeset{Put: []zone.DnsRecord{record}, Version: version})
+			return
+		}
+		err = storage.Patch(r.Context(), zoneId, record)
 		if err != nil {
 			slog.Error("failed to patch record: %v", "error", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -86,6 +307,10 @@ func New(ctx context.Context, addr string,
 		zoneId := r.PathValue("zone")
 		recordId := r.PathValue("record")
 
+		if version := requiredVersion(r); version != "" {
+			applyChanges(w, r, storage, zoneId, zone.Changeset{Delete: []string{recordId}, Version: version})
+			return
+		}
 		storage.Delete(r.Context(), zoneId, recordId)
 	})
 
@@ -126,7 +351,7 @@ func New(ctx context.Context, addr string,
 
 	server := &http.Server{
 		Addr:    addr,
-		Handler: withAuth(mux, apiKeys),
+		Handler: withMetrics(withAuth(mux, apiKeys)),
 	}
 	go server.ListenAndServe()
 
@@ -0,0 +1,78 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/bensku/dove/zone"
+)
+
+// Request body of a changeset: records to put, and ids of records to delete
+type changesRequest struct {
+	Put    []recordWithId `json:"put"`
+	Delete []string       `json:"delete"`
+}
+
+// JSON record with its id, as given in changesets and returned when
+// records are read
+type recordWithId struct {
+	Id string `json:"id"`
+	recordRequest
+}
+
+func newRecordWithId(record zone.DnsRecord) recordWithId {
+	return recordWithId{Id: record.Id, recordRequest: recordRequest{Record: record.Record.String(), DnsRecord: record}}
+}
+
+// parseChanges parses and validates a changeset. Nothing is applied if any
+// of the changes is invalid.
+func parseChanges(body []byte) (zone.Changeset, error) {
+	var req changesRequest
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		return zone.Changeset{}, err
+	}
+
+	var changes zone.Changeset
+	for i, change := range req.Put {
+		err = validateRecordId(change.Id)
+		if err != nil {
+			return zone.Changeset{}, fmt.Errorf("put %d: %v", i, err)
+		}
+		record, err := change.toRecord()
+		if err != nil {
+			return zone.Changeset{}, fmt.Errorf("put %s: %v", change.Id, err)
+		}
+		record.Id = change.Id
+		changes.Put = append(changes.Put, record)
+	}
+	for _, id := range req.Delete {
+		err = validateRecordId(id)
+		if err != nil {
+			return zone.Changeset{}, fmt.Errorf("delete %q: %v", id, err)
+		}
+		changes.Delete = append(changes.Delete, id)
+	}
+	return changes, nil
+}
+
+// applyChanges applies a changeset, responding with an error if it fails.
+// Changesets that are based on an outdated zone version fail with 412.
+func applyChanges(w http.ResponseWriter, r *http.Request, storage zone.ZoneStorage, zoneId string, changes zone.Changeset) bool {
+	err := storage.Apply(r.Context(), zoneId, changes)
+	if errors.Is(err, zone.ErrVersionMismatch) {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return false
+	} else if errors.Is(err, zone.ErrChangesetTooLarge) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	} else if err != nil {
+		slog.Error("failed to apply changeset: %v", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
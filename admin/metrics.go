@@ -0,0 +1,45 @@
+package admin
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "dove_admin_requests_total",
+	Help: "Admin API requests, by route and response status.",
+}, []string{"route", "status"})
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+type metricsMiddleware struct {
+	handler http.Handler
+}
+
+func withMetrics(handler http.Handler) http.Handler {
+	return &metricsMiddleware{handler: handler}
+}
+
+func (mw *metricsMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	mw.handler.ServeHTTP(rec, r)
+
+	// ServeMux fills in the pattern; it is empty for unauthorized or unknown
+	// requests, which keeps arbitrary URLs out of metric labels
+	route := r.Pattern
+	if route == "" {
+		route = "unmatched"
+	}
+	requestsTotal.WithLabelValues(route, strconv.Itoa(rec.status)).Inc()
+}
@@ -0,0 +1,75 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"slices"
+	"strings"
+
+	"github.com/bensku/dove/zone"
+	"github.com/miekg/dns"
+)
+
+// JSON form of record, for setting options in addition to the DNS record
+type recordRequest struct {
+	// DNS record in zone file format
+	Record string `json:"record"`
+	zone.DnsRecord
+}
+
+// parseRecord parses a record from request body. Plain DNS records in zone
+// file format are accepted, as is JSON that also contains record options.
+func parseRecord(contentType string, body []byte) (zone.DnsRecord, error) {
+	req := recordRequest{Record: string(body)}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "application/json" {
+		req = recordRequest{}
+		err := json.Unmarshal(body, &req)
+		if err != nil {
+			return zone.DnsRecord{}, err
+		}
+	}
+	return req.toRecord()
+}
+
+// toRecord parses and validates the DNS record and its options.
+func (req recordRequest) toRecord() (zone.DnsRecord, error) {
+	record := req.DnsRecord
+	rr, err := dns.NewRR(req.Record)
+	if err != nil {
+		return zone.DnsRecord{}, err
+	}
+	if rr == nil {
+		return zone.DnsRecord{}, fmt.Errorf("missing DNS record")
+	}
+	record.Record = rr
+
+	if record.MaxAnswers < 0 {
+		return zone.DnsRecord{}, fmt.Errorf("maxAnswers must not be negative")
+	}
+	if record.HealthCheck != nil {
+		err = record.HealthCheck.Validate()
+		if err != nil {
+			return zone.DnsRecord{}, err
+		}
+	}
+	return record, nil
+}
+
+// Record ids that would be shadowed by other zone endpoints
+var reservedRecordIds = []string{"export", "import", "changes"}
+
+// validateRecordId checks that record id can be set through the API.
+func validateRecordId(id string) error {
+	if id == "" {
+		return fmt.Errorf("missing record id")
+	}
+	if strings.HasPrefix(id, "__") {
+		return fmt.Errorf("record ids starting with __ are reserved")
+	}
+	if slices.Contains(reservedRecordIds, id) {
+		return fmt.Errorf("record id %s is reserved", id)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package admin
+
+import (
+	"net/http"
+	"strings"
+)
+
+// setVersion sends zone version as ETag of the response. Zones that have
+// never been changed have no version.
+func setVersion(w http.ResponseWriter, version string) {
+	if version != "" {
+		w.Header().Set("ETag", `"`+version+`"`)
+	}
+}
+
+// requiredVersion returns zone version that request requires with If-Match,
+// or empty string if any version is fine.
+func requiredVersion(r *http.Request) string {
+	etag := strings.TrimSpace(r.Header.Get("If-Match"))
+	if etag == "*" {
+		return ""
+	}
+	return strings.Trim(strings.TrimPrefix(etag, "W/"), `"`)
+}
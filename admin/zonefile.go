@@ -0,0 +1,48 @@
+package admin
+
+import (
+	"strings"
+
+	"github.com/bensku/dove/zone"
+	"github.com/miekg/dns"
+)
+
+// Import modes: replace all records of zone, or only the RRsets (records
+// of same name and type) that are imported
+const (
+	importReplace = "replace"
+	importMerge   = "merge"
+)
+
+// Name and type of a record, identifying its RRset
+type rrsetKey struct {
+	name   string
+	rrtype uint16
+}
+
+func rrsetOf(rr dns.RR) rrsetKey {
+	return rrsetKey{name: strings.ToLower(rr.Header().Name), rrtype: rr.Header().Rrtype}
+}
+
+// importChanges creates a changeset that imports records to a zone. When
+// replacing, existing records that are not imported are deleted. When
+// merging, only existing records of RRsets that are imported are deleted,
+// so that e.g. a changed address replaces the old one.
+func importChanges(mode string, existing []zone.DnsRecord, records []zone.DnsRecord) zone.Changeset {
+	changes := zone.Changeset{Put: records}
+	imported := make(map[string]bool, len(records))
+	rrsets := make(map[rrsetKey]bool)
+	for _, record := range records {
+		imported[record.Id] = true
+		rrsets[rrsetOf(record.Record)] = true
+	}
+	for _, record := range existing {
+		if imported[record.Id] {
+			continue
+		}
+		if mode == importReplace || rrsets[rrsetOf(record.Record)] {
+			changes.Delete = append(changes.Delete, record.Id)
+		}
+	}
+	return changes
+}
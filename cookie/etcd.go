@@ -0,0 +1,145 @@
+package cookie
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Length of server secrets, as used by SipHash-2-4
+const SecretLength = 16
+
+// How often secrets are reloaded from etcd
+const refreshInterval = 30 * time.Second
+
+// Secrets as stored in etcd
+type storedSecrets struct {
+	// Current secret first, then the previous one
+	Secrets [][]byte `json:"secrets"`
+	// When current secret was created
+	Rotated time.Time `json:"rotated"`
+}
+
+// EtcdSecrets shares server cookie secrets between dove nodes, so that
+// cookies given by one node are accepted by others. Secret is rotated by
+// whichever node first notices that it is too old; the previous secret
+// is kept, so that recently given cookies stay valid.
+type EtcdSecrets struct {
+	client   *clientv3.Client
+	key      string
+	rotation time.Duration
+
+	mutex   sync.RWMutex
+	secrets [][]byte
+}
+
+func NewEtcdSecrets(client *clientv3.Client, key string, rotation time.Duration) *EtcdSecrets {
+	return &EtcdSecrets{
+		client:   client,
+		key:      key,
+		rotation: rotation,
+	}
+}
+
+func newSecret() []byte {
+	secret := make([]byte, SecretLength)
+	rand.Read(secret)
+	return secret
+}
+
+// Secrets returns secrets that cookies are validated with, current first.
+func (store *EtcdSecrets) Secrets() [][]byte {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.secrets
+}
+
+// Start loads secrets and keeps them up to date until context is done.
+// If etcd cannot be reached, a random secret that only this node knows is
+// used until it can.
+func (store *EtcdSecrets) Start(ctx context.Context) {
+	err := store.refresh(ctx)
+	if err != nil {
+		slog.Error("failed to load cookie secrets, using local secret", "error", err)
+		store.mutex.Lock()
+		store.secrets = [][]byte{newSecret()}
+		store.mutex.Unlock()
+	}
+
+	go func() {
+		ticker := time.NewTicker(refreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := store.refresh(ctx)
+				if err != nil {
+					slog.Error("failed to refresh cookie secrets", "error", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// refresh loads secrets from etcd, rotating them first if needed.
+func (store *EtcdSecrets) refresh(ctx context.Context) error {
+	ctx, cancelFunc := context.WithTimeout(ctx, 10*time.Second)
+	defer cancelFunc()
+
+	resp, err := store.client.KV.Get(ctx, store.key)
+	if err != nil {
+		return fmt.Errorf("failed to load cookie secrets: %v", err)
+	}
+	var stored storedSecrets
+	var revision int64 // 0 if the key does not exist
+	if len(resp.Kvs) != 0 {
+		revision = resp.Kvs[0].ModRevision
+		err = json.Unmarshal(resp.Kvs[0].Value, &stored)
+		if err != nil {
+			return fmt.Errorf("failed to parse cookie secrets: %v", err)
+		}
+	}
+
+	if len(stored.Secrets) == 0 || time.Since(stored.Rotated) > store.rotation {
+		// Rotate, unless another node beats us to it
+		secrets := [][]byte{newSecret()}
+		if len(stored.Secrets) != 0 {
+			secrets = append(secrets, stored.Secrets[0])
+		}
+		rotated := storedSecrets{Secrets: secrets, Rotated: time.Now()}
+		data, err := json.Marshal(rotated)
+		if err != nil {
+			return fmt.Errorf("failed to serialize cookie secrets: %v", err)
+		}
+		txn, err := store.client.KV.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(store.key), "=", revision)).
+			Then(clientv3.OpPut(store.key, string(data))).
+			Commit()
+		if err != nil {
+			return fmt.Errorf("failed to rotate cookie secrets: %v", err)
+		}
+		if !txn.Succeeded {
+			return store.refresh(ctx) // Someone else rotated, load their secret
+		}
+		slog.Info("rotated cookie secret")
+		stored = rotated
+	}
+
+	for _, secret := range stored.Secrets {
+		if len(secret) != SecretLength {
+			return fmt.Errorf("invalid cookie secret length %d", len(secret))
+		}
+	}
+	store.mutex.Lock()
+	store.secrets = stored.Secrets
+	store.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,50 @@
+package cookie
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// LocalSecrets rotates server cookie secrets of a standalone dove node,
+// which has no other nodes to share them with.
+type LocalSecrets struct {
+	rotation time.Duration
+
+	mutex   sync.RWMutex
+	secrets [][]byte
+}
+
+func NewLocalSecrets(rotation time.Duration) *LocalSecrets {
+	return &LocalSecrets{
+		rotation: rotation,
+		secrets:  [][]byte{newSecret()},
+	}
+}
+
+// Secrets returns secrets that cookies are validated with, current first.
+func (store *LocalSecrets) Secrets() [][]byte {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.secrets
+}
+
+// Start rotates the secret until context is done.
+func (store *LocalSecrets) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(store.rotation)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				store.mutex.Lock()
+				store.secrets = [][]byte{newSecret(), store.secrets[0]}
+				store.mutex.Unlock()
+				slog.Info("rotated cookie secret")
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
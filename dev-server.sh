@@ -1,2 +1,2 @@
 #!/bin/sh
-go run main.go --etcd-endpoints "http://localhost:2379" --dns-addr ":5300" --accept-keys "test-api-key" --log-level DEBUG --refresh-interval 1
\ No newline at end of file
+go run main.go --etcd-endpoints "http://localhost:2379" --dns-addr ":5300" --accept-keys "test-api-key" --log-level DEBUG --refresh-interval 1 --metrics-addr ":9153"
\ No newline at end of file
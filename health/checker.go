@@ -0,0 +1,190 @@
+package health
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/bensku/dove/zone"
+)
+
+// ResultStore shares health check results between dove nodes, so that
+// all of them agree on which records are healthy.
+type ResultStore interface {
+	// Report records this node's result for a health check.
+	Report(ctx context.Context, key string, healthy bool) error
+	// Forget removes this node's result of a health check that no longer exists.
+	Forget(ctx context.Context, key string) error
+	// Results returns the agreed status of all health checks that have results.
+	Results(ctx context.Context) (map[string]bool, error)
+}
+
+// How often checks are scheduled and shared results are polled
+const (
+	tickInterval = time.Second
+	pollInterval = 2 * time.Second
+)
+
+type checkState struct {
+	zoneId   string
+	recordId string
+	check    zone.HealthCheck
+	nextRun  time.Time
+	running  bool
+	reported bool
+	healthy  bool
+}
+
+type checkResult struct {
+	key     string
+	check   zone.HealthCheck
+	healthy bool
+}
+
+// Checker runs health checks of all records in served zones.
+type Checker struct {
+	store ResultStore
+
+	mutex  sync.RWMutex
+	status map[string]bool
+
+	// Only accessed from run loop
+	checks  map[string]*checkState
+	results chan checkResult
+}
+
+func NewChecker(store ResultStore) *Checker {
+	return &Checker{
+		store:   store,
+		status:  make(map[string]bool),
+		checks:  make(map[string]*checkState),
+		results: make(chan checkResult, 100),
+	}
+}
+
+func checkKey(zoneId string, recordId string) string {
+	return zoneId + "/" + recordId
+}
+
+// Healthy checks if a record is healthy according to results shared by all
+// nodes. Records without health checks or results are considered healthy.
+func (c *Checker) Healthy(zoneId string, recordId string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	healthy, ok := c.status[checkKey(zoneId, recordId)]
+	return !ok || healthy
+}
+
+// Start begins checking records of zones served by given zone server.
+func (c *Checker) Start(ctx context.Context, zones *zone.ZoneServer) {
+	go c.run(ctx, zones)
+}
+
+func (c *Checker) run(ctx context.Context, zones *zone.ZoneServer) {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	lastPoll := time.Time{}
+	for {
+		select {
+		case <-ticker.C:
+			c.schedule(ctx, zones)
+			if time.Since(lastPoll) >= pollInterval {
+				c.poll(ctx)
+				lastPoll = time.Now()
+			}
+		case result := <-c.results:
+			c.handleResult(ctx, result)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// schedule syncs checks with zone content and starts the ones that are due.
+func (c *Checker) schedule(ctx context.Context, zones *zone.ZoneServer) {
+	current := make(map[string]bool)
+	for _, z := range zones.LoadedZones() {
+		for _, record := range z.Records {
+			if record.HealthCheck == nil {
+				continue
+			}
+			key := checkKey(z.Name, record.Id)
+			current[key] = true
+			state, ok := c.checks[key]
+			if !ok || state.check != *record.HealthCheck {
+				// New check, or the check of existing record was changed
+				state = &checkState{zoneId: z.Name, recordId: record.Id, check: *record.HealthCheck}
+				c.checks[key] = state
+			}
+		}
+	}
+
+	now := time.Now()
+	for key, state := range c.checks {
+		if !current[key] {
+			// Record was deleted or its health check removed
+			delete(c.checks, key)
+			if state.reported {
+				err := c.store.Forget(ctx, key)
+				if err != nil {
+					slog.Warn("failed to forget health check result", "key", key, "error", err)
+				}
+			}
+			continue
+		}
+		if state.running || now.Before(state.nextRun) {
+			continue
+		}
+
+		state.running = true
+		state.nextRun = now.Add(state.check.IntervalDuration())
+		go func(key string, check zone.HealthCheck) {
+			checkCtx, cancel := context.WithTimeout(ctx, check.TimeoutDuration())
+			defer cancel()
+			err := Probe(checkCtx, check)
+			if err != nil {
+				slog.Debug("health check failed", "key", key, "error", err)
+			}
+			select {
+			case c.results <- checkResult{key: key, check: check, healthy: err == nil}:
+			case <-ctx.Done():
+			}
+		}(key, state.check)
+	}
+}
+
+func (c *Checker) handleResult(ctx context.Context, result checkResult) {
+	state, ok := c.checks[result.key]
+	if !ok || state.check != result.check {
+		return // Check was removed or changed while it was running
+	}
+	state.running = false
+	if state.reported && state.healthy == result.healthy {
+		return // No change, no need to bother other nodes
+	}
+
+	err := c.store.Report(ctx, result.key, result.healthy)
+	if err != nil {
+		slog.Warn("failed to report health check result", "key", result.key, "error", err)
+		return // Retry after next check
+	}
+	if state.reported {
+		slog.Info("record health changed", "zone", state.zoneId, "record", state.recordId, "healthy", result.healthy)
+	}
+	state.reported = true
+	state.healthy = result.healthy
+}
+
+func (c *Checker) poll(ctx context.Context) {
+	pollCtx, cancel := context.WithTimeout(ctx, pollInterval)
+	defer cancel()
+	status, err := c.store.Results(pollCtx)
+	if err != nil {
+		slog.Warn("failed to load shared health check results", "error", err)
+		return // Keep using previous results
+	}
+	c.mutex.Lock()
+	c.status = status
+	c.mutex.Unlock()
+}
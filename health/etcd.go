@@ -0,0 +1,142 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// How long results of a node survive after it stops refreshing its lease
+const resultTtl = 30
+
+// EtcdResults shares health check results through etcd. Every node stores
+// its own results under a lease, so results of dead nodes expire. Record is
+// considered healthy if at least half of the nodes think it is healthy.
+type EtcdResults struct {
+	client *clientv3.Client
+	prefix string
+	nodeId string
+
+	mutex   sync.Mutex
+	session *concurrency.Session
+	// Results of this node, re-reported if lease is lost
+	results map[string]bool
+}
+
+func NewEtcdResults(client *clientv3.Client, prefix string, nodeId string) *EtcdResults {
+	return &EtcdResults{
+		client:  client,
+		prefix:  prefix,
+		nodeId:  nodeId,
+		results: make(map[string]bool),
+	}
+}
+
+func resultValue(healthy bool) string {
+	if healthy {
+		return "up"
+	}
+	return "down"
+}
+
+// currentSession returns a session whose lease is alive, creating a new one
+// (and re-reporting our results) if needed. Must be called with mutex held.
+func (store *EtcdResults) currentSession(ctx context.Context) (*concurrency.Session, error) {
+	if store.session != nil {
+		select {
+		case <-store.session.Done():
+			store.session = nil // Lease expired, our results are gone
+		default:
+			return store.session, nil
+		}
+	}
+
+	session, err := concurrency.NewSession(store.client, concurrency.WithTTL(resultTtl))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create etcd session: %v", err)
+	}
+	for key, healthy := range store.results {
+		_, err := store.client.KV.Put(ctx, store.prefix+key+"/"+store.nodeId, resultValue(healthy), clientv3.WithLease(session.Lease()))
+		if err != nil {
+			session.Orphan()
+			return nil, fmt.Errorf("failed to restore health check results: %v", err)
+		}
+	}
+	store.session = session
+	return session, nil
+}
+
+func (store *EtcdResults) Report(ctx context.Context, key string, healthy bool) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.results[key] = healthy
+	session, err := store.currentSession(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = store.client.KV.Put(ctx, store.prefix+key+"/"+store.nodeId, resultValue(healthy), clientv3.WithLease(session.Lease()))
+	if err != nil {
+		return fmt.Errorf("failed to store health check result: %v", err)
+	}
+	return nil
+}
+
+func (store *EtcdResults) Forget(ctx context.Context, key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.results, key)
+	_, err := store.client.KV.Delete(ctx, store.prefix+key+"/"+store.nodeId)
+	if err != nil {
+		return fmt.Errorf("failed to delete health check result: %v", err)
+	}
+	return nil
+}
+
+func (store *EtcdResults) Results(ctx context.Context) (map[string]bool, error) {
+	resp, err := store.client.KV.Get(ctx, store.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load health check results: %v", err)
+	}
+
+	// Count votes of all nodes
+	up := make(map[string]int)
+	down := make(map[string]int)
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key[len(store.prefix):])
+		nodeStart := strings.LastIndexByte(key, '/')
+		if nodeStart == -1 {
+			continue
+		}
+		key = key[:nodeStart]
+		if string(kv.Value) == "up" {
+			up[key]++
+		} else {
+			down[key]++
+		}
+	}
+
+	results := make(map[string]bool)
+	for key, count := range down {
+		results[key] = up[key] >= count
+	}
+	for key := range up {
+		if _, ok := results[key]; !ok {
+			results[key] = true
+		}
+	}
+	return results, nil
+}
+
+func (store *EtcdResults) Close() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.session != nil {
+		store.session.Close() // Revokes lease, removing our results
+	}
+}
+
+var _ ResultStore = (*EtcdResults)(nil)
@@ -0,0 +1,42 @@
+package health
+
+import (
+	"context"
+	"maps"
+	"sync"
+)
+
+// LocalResults keeps health check results of a standalone dove node, whose
+// results are not shared with anyone.
+type LocalResults struct {
+	mutex   sync.Mutex
+	results map[string]bool
+}
+
+func NewLocalResults() *LocalResults {
+	return &LocalResults{
+		results: make(map[string]bool),
+	}
+}
+
+func (store *LocalResults) Report(ctx context.Context, key string, healthy bool) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.results[key] = healthy
+	return nil
+}
+
+func (store *LocalResults) Forget(ctx context.Context, key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.results, key)
+	return nil
+}
+
+func (store *LocalResults) Results(ctx context.Context) (map[string]bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return maps.Clone(store.results), nil
+}
+
+var _ ResultStore = (*LocalResults)(nil)
@@ -0,0 +1,59 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/bensku/dove/zone"
+	"github.com/miekg/dns"
+)
+
+// Probe runs a health check once. It returns nil if the target is healthy.
+func Probe(ctx context.Context, check zone.HealthCheck) error {
+	switch check.Type {
+	case zone.HealthCheckTCP:
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", check.Target)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case zone.HealthCheckHTTP:
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, check.Target, nil)
+		if err != nil {
+			return err
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		expected := check.ExpectStatus
+		if expected == 0 {
+			expected = http.StatusOK
+		}
+		if res.StatusCode != expected {
+			return fmt.Errorf("expected status %d, got %d", expected, res.StatusCode)
+		}
+		return nil
+	case zone.HealthCheckDNS:
+		qtype := dns.TypeA
+		if check.QueryType != "" {
+			qtype = dns.StringToType[check.QueryType]
+		}
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(check.QueryName), qtype)
+		r, _, err := new(dns.Client).ExchangeContext(ctx, m, check.Target)
+		if err != nil {
+			return err
+		}
+		if r.Rcode != dns.RcodeSuccess {
+			return fmt.Errorf("query failed with %s", dns.RcodeToString[r.Rcode])
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown health check type '%s'", check.Type)
+	}
+}
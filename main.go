@@ -4,62 +4,357 @@ import (
 	"context"
 	"flag"
 	"log/slog"
+	"net/netip"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/bensku/dove/admin"
+	"github.com/bensku/dove/cookie"
+	"github.com/bensku/dove/health"
+	"github.com/bensku/dove/metrics"
 	"github.com/bensku/dove/nameserver"
 	"github.com/bensku/dove/zone"
+	"github.com/miekg/dns"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
 func main() {
-	httpListen := flag.String("admin-addr", ":8080", "Listen address for HTTP admin API")
-	dnsListen := flag.String("dns-addr", ":53", "Listen address for DNS server")
-	etcdEndpoints := flag.String("etcd-endpoints", "", "Comma-separated list of etcd endpoints")
-	etcdPrefix := flag.String("etcd-prefix", "/dove/zones", "Etcd prefix for zone data")
-	localData := flag.String("fallback-dir", "/tmp/dove/zones", "Local path for fallback zone data, to be used if etcd is unavailable")
-	refreshInterval := flag.Int("refresh-interval", 5, "How often local zone data is refreshed from etcd (in seconds)")
-	apiKeys := flag.String("accept-keys", "", "Comma-separated list of accepted API keys for admin API")
-	logLevel := flag.String("log-level", "INFO", "Log level")
-	flag.Parse()
-
-	if *etcdEndpoints == "" {
-		slog.Error("--etcd-endpoints is required")
-		return
-	}
+	ctx, cancelFunc := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancelFunc()
+	run(ctx, os.Args[1:])
+}
+
+// run starts dove with given command-line arguments and serves until
+// context is done.
+func run(ctx context.Context, args []string) {
+	flags := flag.NewFlagSet("dove", flag.ExitOnError)
+	httpListen := flags.String("admin-addr", ":8080", "Listen address for HTTP admin API")
+	dnsListen := flags.String("dns-addr", ":53", "Listen address for DNS server")
+	storageType := flags.String("storage", "etcd", "Primary zone storage: etcd, sql, bolt, directory or memory")
+	etcdEndpoints := flags.String("etcd-endpoints", "", "Comma-separated list of etcd endpoints")
+	sqlDriver := flags.String("sql-driver", "sqlite", "Database of SQL zone storage: sqlite or postgres")
+	sqlDsn := flags.String("sql-dsn", "", "Data source name (file path or connection URL) of SQL zone storage")
+	boltPath := flags.String("bolt-path", "", "Database file of bolt zone storage")
+	zoneDir := flags.String("zone-dir", "", "Directory of <zone>.zone files to serve with directory storage")
+	syncZoneDir := flags.String("sync-zone-dir", "", "Directory of <zone>.zone files to keep synced into primary zone storage")
+	etcdPrefix := flags.String("etcd-prefix", "/dove/zones", "Etcd prefix for zone data")
+	fallbackType := flags.String("fallback-storage", "file", "Fallback zone storage, to be used if primary is unavailable: file or bolt")
+	localData := flags.String("fallback-dir", "/tmp/dove/zones", "Local path for fallback zone data of file storage")
+	fallbackDb := flags.String("fallback-db", "/tmp/dove/fallback.db", "Database file of bolt fallback storage; zones in --fallback-dir are migrated to it")
+	refreshInterval := flags.Int("refresh-interval", 5, "How often local zone data is refreshed from etcd (in seconds)")
+	staleThreshold := flags.Int("stale-threshold", 60, "How long zone data can go without successful refresh before answers are marked stale (in seconds, 0 to disable)")
+	apiKeys := flags.String("accept-keys", "", "Comma-separated list of accepted API keys for admin API")
+	metricsListen := flags.String("metrics-addr", "", "Listen address for Prometheus metrics endpoint (disabled if empty)")
+	dnstapSocket := flags.String("dnstap-socket", "", "Unix socket of dnstap collector to send queries and responses to")
+	dnstapFile := flags.String("dnstap-file", "", "File to write dnstap data to, if no socket is given")
+	dnstapSampleRate := flags.Float64("dnstap-sample-rate", 1, "Fraction of queries to log with dnstap, from 0 to 1")
+	dnstapZones := flags.String("dnstap-zones", "", "Comma-separated list of zones to log with dnstap (default all zones)")
+	dnstapIdentity := flags.String("dnstap-identity", "", "Server identity for dnstap messages (default node id)")
+	queryLogLevel := flags.String("query-log-level", "OFF", "Initial query log level: INFO logs queries, DEBUG also answers, OFF disables (can be changed at runtime)")
+	queryLogFile := flags.String("query-log-file", "", "File to append JSON query log to (default stdout)")
+	queryLogSampleRate := flags.Float64("query-log-sample-rate", 1, "Fraction of queries to include in query log, from 0 to 1")
+	queryLogZones := flags.String("query-log-zones", "", "Comma-separated list of zones to include in query log (default all zones)")
+	nodeId := flags.String("node-id", "", "Unique name of this dove node (default hostname)")
+	chaosVersion := flags.String("chaos-version", "dove", "Answer to version.bind and version.server CHAOS queries, \"none\" to hide")
+	chaosId := flags.String("chaos-id", "", "Answer to hostname.bind and id.server CHAOS queries, \"none\" to hide (default node id)")
+	nsid := flags.String("nsid", "", "Value of EDNS NSID option, \"none\" to disable (default node id)")
+	healthChecks := flags.Bool("health-checks", true, "Run health checks of records and leave unhealthy records out of answers")
+	geoipDb := flags.String("geoip-db", "", "MaxMind-format (MMDB) country database for location-tagged records")
+	ecs := flags.Bool("ecs", true, "Use EDNS Client Subnet options of queries to choose answers")
+	ecsTrusted := flags.String("ecs-trusted-networks", "", "Comma-separated list of resolver networks whose EDNS Client Subnet options are used (default all)")
+	cookies := flags.Bool("cookies", true, "Support DNS cookies, with secret shared between nodes through etcd")
+	enforceCookies := flags.Bool("cookies-enforce", false, "Refuse UDP queries with invalid or expired server cookies with BADCOOKIE, instead of answering them normally")
+	cookieRotation := flags.Int("cookie-rotation", 86400, "How often DNS cookie secret is rotated, in seconds (at least 3600)")
+	anyPolicy := flags.String("any-policy", nameserver.AnyHinfo, "How ANY queries are answered: hinfo (RFC 8482 HINFO record), rrset (one RRset) or tcp (all records, over TCP only)")
+	transferKeys := flags.String("transfer-keys", "", "Comma-separated list of TSIG keys whose clients get full answers to ANY queries")
+	tsigKeys := flags.String("tsig-keys", "", "JSON file with TSIG key names and their base64-encoded secrets")
+	viewsFile := flags.String("views", "", "JSON file with split-horizon view definitions")
+	logLevel := flags.String("log-level", "INFO", "Log level")
+	flags.Parse(args)
 
 	// Setup logging
 	var programLevel = new(slog.LevelVar)
 	programLevel.UnmarshalText([]byte(*logLevel))
 	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: programLevel})))
 
-	ctx, cancelFunc := context.WithCancel(context.Background())
+	if *nodeId == "" {
+		*nodeId, _ = os.Hostname()
+	}
+	if *dnstapIdentity == "" {
+		*dnstapIdentity = *nodeId
+	}
+	if *chaosId == "" {
+		*chaosId = *nodeId
+	}
+	if *nsid == "" {
+		*nsid = *nodeId
+	}
+
+	// Keep running until health check results are removed from etcd
+	stop := ctx.Done()
+	ctx, cancelFunc := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelFunc()
 
-	etcdClient, err := clientv3.New(clientv3.Config{
-		Context:   ctx,
-		Endpoints: strings.Split(*etcdEndpoints, ","),
+	var etcdClient *clientv3.Client
+	var primary zone.ZoneStorage
+	var err error
+	switch *storageType {
+	case "etcd":
+		if *etcdEndpoints == "" {
+			slog.Error("--etcd-endpoints is required for etcd storage")
+			return
+		}
+		etcdClient, err = clientv3.New(clientv3.Config{
+			Context:   ctx,
+			Endpoints: strings.Split(*etcdEndpoints, ","),
+		})
+		if err != nil {
+			slog.Error("failed to connect to primary zone storage", "error", err)
+			return
+		}
+		primary = zone.NewEtcdStorage(etcdClient, *etcdPrefix)
+	case "sql":
+		if *sqlDsn == "" {
+			slog.Error("--sql-dsn is required for SQL storage")
+			return
+		}
+		sqlStorage, err := zone.NewSqlStorage(ctx, *sqlDriver, *sqlDsn)
+		if err != nil {
+			slog.Error("failed to connect to primary zone storage", "error", err)
+			return
+		}
+		defer sqlStorage.Close()
+		primary = sqlStorage
+	case "bolt":
+		if *boltPath == "" {
+			slog.Error("--bolt-path is required for bolt storage")
+			return
+		}
+		boltStorage, err := zone.NewBoltStorage(*boltPath)
+		if err != nil {
+			slog.Error("failed to open primary zone storage", "error", err)
+			return
+		}
+		defer boltStorage.Close()
+		primary = boltStorage
+	case "directory":
+		if *zoneDir == "" {
+			slog.Error("--zone-dir is required for directory storage")
+			return
+		}
+		primary, err = zone.NewDirectoryStorage(*zoneDir)
+		if err != nil {
+			slog.Error("failed to open primary zone storage", "error", err)
+			return
+		}
+	case "memory":
+		slog.Warn("using in-memory zone storage, zones will be lost when dove stops")
+		primary = zone.NewMemoryStorage()
+	default:
+		slog.Error("unknown zone storage", "storage", *storageType)
+		return
+	}
+	if *syncZoneDir != "" {
+		source, err := zone.NewDirectoryStorage(*syncZoneDir)
+		if err != nil {
+			slog.Error("failed to open zone directory to sync", "error", err)
+			return
+		}
+		zone.StartSync(ctx, source, primary, time.Duration(*refreshInterval)*time.Second)
+	}
+
+	var fallback zone.ZoneStorage
+	switch *fallbackType {
+	case "file":
+		fallback, err = zone.NewFileStorage(*localData)
+		if err != nil {
+			slog.Error("failed initialize fallback local storage", "error", err)
+			return
+		}
+	case "bolt":
+		if *storageType == "bolt" && *boltPath == *fallbackDb {
+			slog.Error("--fallback-db must differ from --bolt-path")
+			return
+		}
+		err = os.MkdirAll(filepath.Dir(*fallbackDb), 0o744)
+		if err != nil {
+			slog.Error("failed initialize fallback local storage", "error", err)
+			return
+		}
+		boltStorage, err := zone.NewBoltStorage(*fallbackDb)
+		if err != nil {
+			slog.Error("failed initialize fallback local storage", "error", err)
+			return
+		}
+		defer boltStorage.Close()
+		err = boltStorage.MigrateFallbackDir(ctx, *localData)
+		if err != nil {
+			slog.Error("failed to migrate fallback directory", "error", err)
+			return
+		}
+		fallback = boltStorage
+	default:
+		slog.Error("unknown fallback storage", "storage", *fallbackType)
+		return
+	}
+
+	queryLogOutput := os.Stdout
+	if *queryLogFile != "" {
+		queryLogOutput, err = os.OpenFile(*queryLogFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			slog.Error("failed to open query log file", "error", err)
+			return
+		}
+	}
+	queryLog, err := nameserver.NewQueryLog(queryLogOutput, nameserver.QueryLogConfig{
+		Level:      *queryLogLevel,
+		SampleRate: *queryLogSampleRate,
+		Zones:      splitList(*queryLogZones),
 	})
 	if err != nil {
-		slog.Error("failed to connect to primary zone storage", "error", err)
+		slog.Error("failed to configure query log", "error", err)
 		return
 	}
-	primary := zone.NewEtcdStorage(etcdClient, *etcdPrefix)
-	fallback, err := zone.NewFileStorage(*localData)
-	if err != nil {
-		slog.Error("failed initialize fallback local storage", "error", err)
+
+	var healthResults *health.EtcdResults
+	var checker *health.Checker
+	var recordHealth nameserver.RecordHealth
+	if *healthChecks {
+		if etcdClient != nil {
+			healthResults = health.NewEtcdResults(etcdClient, *etcdPrefix+"__health/", *nodeId)
+			checker = health.NewChecker(healthResults)
+		} else {
+			checker = health.NewChecker(health.NewLocalResults())
+		}
+		recordHealth = checker
+	}
+
+	var geoLocator nameserver.GeoLocator
+	if *geoipDb != "" {
+		geoDb, err := nameserver.OpenGeoDatabase(ctx, *geoipDb)
+		if err != nil {
+			slog.Error("failed to load GeoIP database", "error", err)
+			return
+		}
+		geoLocator = geoDb
+	}
+
+	var ecsTrustedNetworks []netip.Prefix
+	for _, network := range splitList(*ecsTrusted) {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			slog.Error("invalid ECS trusted network", "error", err)
+			return
+		}
+		ecsTrustedNetworks = append(ecsTrustedNetworks, prefix)
+	}
+
+	switch *anyPolicy {
+	case nameserver.AnyHinfo, nameserver.AnyRRset, nameserver.AnyTcp:
+	default:
+		slog.Error("unknown ANY policy", "policy", *anyPolicy)
 		return
 	}
 
-	nameserver.New(ctx, *dnsListen, primary, fallback, time.Duration(*refreshInterval)*time.Second)
-	admin.New(ctx, *httpListen, primary, strings.Split(*apiKeys, ","))
+	var tsigSecrets map[string]string
+	if *tsigKeys != "" {
+		tsigSecrets, err = nameserver.LoadTsigSecrets(*tsigKeys)
+		if err != nil {
+			slog.Error("failed to load TSIG keys", "error", err)
+			return
+		}
+	}
+	for _, key := range splitList(*transferKeys) {
+		if _, ok := tsigSecrets[dns.CanonicalName(key)]; !ok {
+			slog.Error("unknown transfer key", "key", key)
+			return
+		}
+	}
+	var views []nameserver.View
+	if *viewsFile != "" {
+		views, err = nameserver.LoadViews(*viewsFile, tsigSecrets)
+		if err != nil {
+			slog.Error("failed to load views", "error", err)
+			return
+		}
+	}
+
+	var cookieSecrets nameserver.CookieSecrets
+	if *cookies {
+		if *cookieRotation < 3600 {
+			slog.Error("--cookie-rotation must be at least 3600 seconds, as cookies are valid for an hour")
+			return
+		}
+		rotation := time.Duration(*cookieRotation) * time.Second
+		if etcdClient != nil {
+			etcdSecrets := cookie.NewEtcdSecrets(etcdClient, *etcdPrefix+"__cookies", rotation)
+			etcdSecrets.Start(ctx)
+			cookieSecrets = etcdSecrets
+		} else {
+			localSecrets := cookie.NewLocalSecrets(rotation)
+			localSecrets.Start(ctx)
+			cookieSecrets = localSecrets
+		}
+	}
+
+	ns := nameserver.New(ctx, *dnsListen, primary, fallback, time.Duration(*refreshInterval)*time.Second, nameserver.Options{
+		StaleThreshold: time.Duration(*staleThreshold) * time.Second,
+		Dnstap: nameserver.DnstapOptions{
+			Socket:     *dnstapSocket,
+			File:       *dnstapFile,
+			SampleRate: *dnstapSampleRate,
+			Zones:      splitList(*dnstapZones),
+			Identity:   *dnstapIdentity,
+		},
+		QueryLog:           queryLog,
+		Health:             recordHealth,
+		Geo:                geoLocator,
+		IgnoreEcs:          !*ecs,
+		EcsTrustedNetworks: ecsTrustedNetworks,
+		Chaos: nameserver.ChaosOptions{
+			Version: hideNone(*chaosVersion),
+			Id:      hideNone(*chaosId),
+			Nsid:    hideNone(*nsid),
+		},
+		Cookies:        cookieSecrets,
+		EnforceCookies: *enforceCookies,
+		AnyPolicy:      *anyPolicy,
+		TransferKeys:   splitList(*transferKeys),
+		Views:          views,
+		TsigSecrets:    tsigSecrets,
+	})
+	if checker != nil {
+		checker.Start(ctx, ns.Zones())
+	}
+	admin.New(ctx, *httpListen, primary, ns.Zones(), queryLog, strings.Split(*apiKeys, ","))
+	if *metricsListen != "" {
+		metrics.New(ctx, *metricsListen, ns.Zones())
+	}
 
-	// Shutdown on SIGINT
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	<-c
-	slog.Info("Received SIGINT, shutting down...")
+	<-stop
+	slog.Info("Shutting down...")
+	if healthResults != nil {
+		healthResults.Close() // Let other nodes know that our results are gone
+	}
 	cancelFunc()
+	ns.Wait()
+}
+
+// hideNone maps "none" flag value to empty string, which hides the value.
+func hideNone(value string) string {
+	if value == "none" {
+		return ""
+	}
+	return value
+}
+
+// splitList splits a comma-separated flag value, returning nil for empty value.
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
 }
@@ -1,18 +1,60 @@
-package main_test
+package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"os"
 	"slices"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+// TestMain runs dove with in-memory zone storage for the tests, or with
+// etcd if DOVE_TEST_ETCD_ENDPOINTS is set.
+func TestMain(m *testing.M) {
+	fallbackDir, err := os.MkdirTemp("", "dove-test")
+	if err != nil {
+		panic(err)
+	}
+	args := []string{"--dns-addr", ":5300", "--accept-keys", "test-api-key", "--log-level", "DEBUG",
+		"--refresh-interval", "1", "--metrics-addr", ":9153", "--fallback-dir", fallbackDir}
+	if endpoints := os.Getenv("DOVE_TEST_ETCD_ENDPOINTS"); endpoints != "" {
+		args = append(args, "--etcd-endpoints", endpoints)
+	} else {
+		args = append(args, "--storage", "memory")
+	}
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		run(ctx, args)
+		close(stopped)
+	}()
+
+	// Wait for admin API to come up
+	for range 50 {
+		res, err := http.Get("http://localhost:8080/api/v1/zone")
+		if err == nil {
+			res.Body.Close()
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	code := m.Run()
+	cancelFunc()
+	<-stopped
+	os.RemoveAll(fallbackDir)
+	os.Exit(code)
+}
+
 func request(method, url string, payload []byte) string {
 	var req *http.Request
 	var err error
@@ -180,3 +222,423 @@ func TestRecords(t *testing.T) {
 	// Delete the zone
 	request("DELETE", "http://localhost:8080/api/v1/zone/dove.test.", nil)
 }
+
+func TestZoneStatus(t *testing.T) {
+	request("PUT", "http://localhost:8080/api/v1/zone/dove.test.", nil)
+	request("PUT", "http://localhost:8080/api/v1/zone/dove.test./test1", []byte("@ 300 IN A 1.2.3.4"))
+	time.Sleep(2 * time.Second)
+
+	var status struct {
+		Zones []struct {
+			Name  string `json:"name"`
+			Stale bool   `json:"stale"`
+		} `json:"zones"`
+	}
+	err := json.Unmarshal([]byte(request("GET", "http://localhost:8080/api/v1/status", nil)), &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Zones) != 1 || status.Zones[0].Name != "dove.test." {
+		t.Errorf("unexpected zone status: %v", status)
+	} else if status.Zones[0].Stale {
+		t.Errorf("zone refreshed from primary should not be stale")
+	}
+
+	// Fresh answers must not carry Extended DNS Errors
+	c := new(dns.Client)
+	m := new(dns.Msg)
+	m.SetQuestion("dove.test.", dns.TypeA)
+	m.SetEdns0(1232, false)
+	r, _, err := c.Exchange(m, "127.0.0.1:5300")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt := r.IsEdns0()
+	if opt == nil {
+		t.Fatal("EDNS query should get EDNS response")
+	}
+	for _, option := range opt.Option {
+		if option.Option() == dns.EDNS0EDE {
+			t.Errorf("unexpected Extended DNS Error: %s", option)
+		}
+	}
+
+	request("DELETE", "http://localhost:8080/api/v1/zone/dove.test.", nil)
+}
+
+func TestMetrics(t *testing.T) {
+	request("PUT", "http://localhost:8080/api/v1/zone/dove.test.", nil)
+	request("PUT", "http://localhost:8080/api/v1/zone/dove.test./test1", []byte("@ 300 IN A 1.2.3.4"))
+	time.Sleep(2 * time.Second)
+	queryRecords("dove.test.", dns.TypeA)
+
+	res, err := http.Get("http://localhost:9153/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`dove_dns_queries_total{qtype="A",rcode="NOERROR",transport="udp",zone="dove.test."}`,
+		`dove_zone_records{zone="dove.test."} 1`,
+		`dove_admin_requests_total{route="PUT /api/v1/zone/{zone}/{record}",status="200"}`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("metrics did not contain %s", expected)
+		}
+	}
+
+	request("DELETE", "http://localhost:8080/api/v1/zone/dove.test.", nil)
+}
+
+func TestQueryLogConfig(t *testing.T) {
+	request("PUT", "http://localhost:8080/api/v1/querylog", []byte(`{"level":"INFO","sampleRate":0.5}`))
+	config := request("GET", "http://localhost:8080/api/v1/querylog", nil)
+	if config != `{"level":"INFO","sampleRate":0.5,"zones":null}` {
+		t.Errorf("query log config was not changed: %s", config)
+	}
+	request("PUT", "http://localhost:8080/api/v1/querylog", []byte(`{"level":"OFF","sampleRate":1}`))
+}
+
+func requestJson(method, url string, payload string) string {
+	req, err := http.NewRequest(method, url, strings.NewReader(payload))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Authorization", "test-api-key")
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	if res.StatusCode >= 400 {
+		panic(fmt.Errorf("request failed with status %d", res.StatusCode))
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		panic(err)
+	}
+	return string(body)
+}
+
+func TestHealthChecks(t *testing.T) {
+	request("PUT", "http://localhost:8080/api/v1/zone/dove.test.", nil)
+	// Admin API port is open, port 1 should not be
+	requestJson("PUT", "http://localhost:8080/api/v1/zone/dove.test./up",
+		`{"record": "www 300 IN A 1.2.3.4", "healthCheck": {"type": "tcp", "target": "127.0.0.1:8080", "interval": 1}}`)
+	requestJson("PUT", "http://localhost:8080/api/v1/zone/dove.test./down",
+		`{"record": "www 300 IN A 1.2.3.5", "healthCheck": {"type": "tcp", "target": "127.0.0.1:1", "interval": 1}}`)
+	request("PUT", "http://localhost:8080/api/v1/zone/dove.test./down2", []byte("api 300 IN A 1.2.3.6"))
+	requestJson("PUT", "http://localhost:8080/api/v1/zone/dove.test./down3",
+		`{"record": "api 300 IN A 1.2.3.7", "healthCheck": {"type": "http", "target": "http://127.0.0.1:1/", "interval": 1}}`)
+	time.Sleep(5 * time.Second)
+
+	rr := queryRecords("www.dove.test.", dns.TypeA)
+	if !recordsEqual(rr, []string{"www.dove.test. 300 IN A 1.2.3.4"}) {
+		t.Errorf("unhealthy record should not be returned: %s", rr)
+	}
+	rr = queryRecords("api.dove.test.", dns.TypeA)
+	if !recordsEqual(rr, []string{"api.dove.test. 300 IN A 1.2.3.6"}) {
+		t.Errorf("record without health check should be returned: %s", rr)
+	}
+
+	// When everything is down, return everything
+	request("DELETE", "http://localhost:8080/api/v1/zone/dove.test./up", nil)
+	time.Sleep(2 * time.Second)
+	rr = queryRecords("www.dove.test.", dns.TypeA)
+	if !recordsEqual(rr, []string{"www.dove.test. 300 IN A 1.2.3.5"}) {
+		t.Errorf("should fail open when all records are unhealthy: %s", rr)
+	}
+
+	request("DELETE", "http://localhost:8080/api/v1/zone/dove.test.", nil)
+}
+
+func TestAutoReverse(t *testing.T) {
+	request("PUT", "http://localhost:8080/api/v1/zone/dove.test.", nil)
+	request("PUT", "http://localhost:8080/api/v1/zone/dove.test./www", []byte("www 300 IN A 192.0.2.10"))
+	request("PUT", "http://localhost:8080/api/v1/zone/dove.test./mail", []byte("mail 600 IN A 192.0.2.10"))
+	request("PUT", "http://localhost:8080/api/v1/zone/dove.test./host", []byte("host 300 IN A 192.0.2.11"))
+	request("PUT", "http://localhost:8080/api/v1/zone/2.0.192.in-addr.arpa.",
+		[]byte(`{"autoReverse": {"ambiguous": "first"}}`))
+	request("PUT", "http://localhost:8080/api/v1/zone/2.0.192.in-addr.arpa./custom", []byte("11 300 IN PTR custom.dove.test."))
+	time.Sleep(2 * time.Second)
+
+	rr := queryRecords("10.2.0.192.in-addr.arpa.", dns.TypePTR)
+	if !recordsEqual(rr, []string{"10.2.0.192.in-addr.arpa. 600 IN PTR mail.dove.test."}) {
+		t.Errorf("incorrect synthesized PTR: %s", rr)
+	}
+	rr = queryRecords("11.2.0.192.in-addr.arpa.", dns.TypePTR)
+	if !recordsEqual(rr, []string{"11.2.0.192.in-addr.arpa. 300 IN PTR custom.dove.test."}) {
+		t.Errorf("explicit PTR should win: %s", rr)
+	}
+	rr = queryRecords("12.2.0.192.in-addr.arpa.", dns.TypePTR)
+	if len(rr) != 0 {
+		t.Errorf("nothing points to address, got %s", rr)
+	}
+
+	// Ambiguous names can also be refused
+	request("PUT", "http://localhost:8080/api/v1/zone/2.0.192.in-addr.arpa.",
+		[]byte(`{"autoReverse": {"ambiguous": "none"}}`))
+	time.Sleep(2 * time.Second)
+	rr = queryRecords("10.2.0.192.in-addr.arpa.", dns.TypePTR)
+	if len(rr) != 0 {
+		t.Errorf("ambiguous PTR should not be synthesized: %s", rr)
+	}
+
+	request("DELETE", "http://localhost:8080/api/v1/zone/2.0.192.in-addr.arpa.", nil)
+	request("DELETE", "http://localhost:8080/api/v1/zone/dove.test.", nil)
+}
+
+func TestSynthesizedRecords(t *testing.T) {
+	request("PUT", "http://localhost:8080/api/v1/zone/dove.test.",
+		[]byte(`{"synthesize": [{"subtree": "dev", "ttl": 30, "allowedNetworks": ["10.0.0.0/8"]}]}`))
+	request("PUT", "http://localhost:8080/api/v1/zone/dove.test./explicit", []byte("10-0-0-6.dev 300 IN A 192.0.2.1"))
+	time.Sleep(2 * time.Second)
+
+	rr := queryRecords("10-0-0-5.dev.dove.test.", dns.TypeA)
+	if !recordsEqual(rr, []string{"10-0-0-5.dev.dove.test. 30 IN A 10.0.0.5"}) {
+		t.Errorf("incorrect synthesized record: %s", rr)
+	}
+	rr = queryRecords("10-0-0-6.dev.dove.test.", dns.TypeA)
+	if !recordsEqual(rr, []string{"10-0-0-6.dev.dove.test. 300 IN A 192.0.2.1"}) {
+		t.Errorf("existing record should win: %s", rr)
+	}
+	rr = queryRecords("192-0-2-1.dev.dove.test.", dns.TypeA)
+	if len(rr) != 0 {
+		t.Errorf("address outside allowed networks was synthesized: %s", rr)
+	}
+
+	request("DELETE", "http://localhost:8080/api/v1/zone/dove.test.", nil)
+}
+
+func TestZoneFiles(t *testing.T) {
+	request("PUT", "http://localhost:8080/api/v1/zone/dove.test.", nil)
+	request("PUT", "http://localhost:8080/api/v1/zone/dove.test./manual", []byte("manual 300 IN A 192.0.2.9"))
+	zoneFile := `$ORIGIN dove.test.
+$TTL 600
+@ IN A 192.0.2.1
+www 300 IN CNAME @
+mail IN A 192.0.2.2
+mail IN A 192.0.2.2
+`
+	request("POST", "http://localhost:8080/api/v1/zone/dove.test./import", []byte(zoneFile))
+	time.Sleep(2 * time.Second)
+
+	rr := queryRecords("www.dove.test.", dns.TypeCNAME)
+	if !recordsEqual(rr, []string{"www.dove.test. 300 IN CNAME dove.test."}) {
+		t.Errorf("incorrect imported record: %s", rr)
+	}
+	rr = queryRecords("mail.dove.test.", dns.TypeA)
+	if !recordsEqual(rr, []string{"mail.dove.test. 600 IN A 192.0.2.2"}) {
+		t.Errorf("duplicate records should be imported once: %s", rr)
+	}
+	rr = queryRecords("manual.dove.test.", dns.TypeA)
+	if len(rr) != 1 {
+		t.Errorf("merge should keep existing records: %s", rr)
+	}
+
+	// Merging replaces RRsets that are imported
+	request("POST", "http://localhost:8080/api/v1/zone/dove.test./import", []byte("mail.dove.test. 600 IN A 192.0.2.5"))
+	time.Sleep(2 * time.Second)
+	rr = queryRecords("mail.dove.test.", dns.TypeA)
+	if !recordsEqual(rr, []string{"mail.dove.test. 600 IN A 192.0.2.5"}) {
+		t.Errorf("merge should replace changed records: %s", rr)
+	}
+	rr = queryRecords("manual.dove.test.", dns.TypeA)
+	if len(rr) != 1 {
+		t.Errorf("merge should keep other RRsets: %s", rr)
+	}
+
+	// Exported zone can be imported again with same ids
+	exported := request("GET", "http://localhost:8080/api/v1/zone/dove.test./export", nil)
+	if !strings.HasPrefix(exported, "$ORIGIN dove.test.\n$TTL 600\n") || !strings.Contains(exported, "\nwww\t300\tIN\tCNAME\tdove.test.\n") {
+		t.Errorf("unexpected export: %s", exported)
+	}
+	request("POST", "http://localhost:8080/api/v1/zone/dove.test./import?mode=replace", []byte(exported))
+	reexported := request("GET", "http://localhost:8080/api/v1/zone/dove.test./export", nil)
+	if reexported != exported {
+		t.Errorf("zone changed when importing its export:\n%s\n%s", exported, reexported)
+	}
+
+	// Replace removes records that are not in the file
+	request("POST", "http://localhost:8080/api/v1/zone/dove.test./import?mode=replace", []byte("www.dove.test. 300 IN A 192.0.2.3"))
+	time.Sleep(2 * time.Second)
+	rr = queryRecords("mail.dove.test.", dns.TypeA)
+	if len(rr) != 0 {
+		t.Errorf("replaced records should be gone: %s", rr)
+	}
+	rr = queryRecords("www.dove.test.", dns.TypeA)
+	if !recordsEqual(rr, []string{"www.dove.test. 300 IN A 192.0.2.3"}) {
+		t.Errorf("incorrect replaced record: %s", rr)
+	}
+
+	// Imports are rejected as a whole
+	status, _ := conditionalRequest("POST", "http://localhost:8080/api/v1/zone/dove.test./import?mode=replace",
+		"mail.dove.test. 300 IN A 192.0.2.4", "outdated-version")
+	if status != http.StatusPreconditionFailed {
+		t.Errorf("import based on outdated version should fail with 412, got %d", status)
+	}
+	time.Sleep(2 * time.Second)
+	rr = queryRecords("www.dove.test.", dns.TypeA)
+	if !recordsEqual(rr, []string{"www.dove.test. 300 IN A 192.0.2.3"}) {
+		t.Errorf("rejected imports should not change records: %s", rr)
+	}
+	rr = queryRecords("mail.dove.test.", dns.TypeA)
+	if len(rr) != 0 {
+		t.Errorf("rejected imports should not add records: %s", rr)
+	}
+
+	// Large zones are imported too, even if they do not fit in one etcd
+	// transaction
+	var large strings.Builder
+	for i := range 200 {
+		fmt.Fprintf(&large, "host%d.dove.test. 300 IN A 192.0.2.%d\n", i, i)
+	}
+	status, _ = conditionalRequest("POST", "http://localhost:8080/api/v1/zone/dove.test./import?mode=replace", large.String(), "")
+	if status != http.StatusOK {
+		t.Errorf("large import failed with %d", status)
+	}
+	time.Sleep(2 * time.Second)
+	rr = queryRecords("host199.dove.test.", dns.TypeA)
+	if !recordsEqual(rr, []string{"host199.dove.test. 300 IN A 192.0.2.199"}) {
+		t.Errorf("incorrect record from large import: %s", rr)
+	}
+	rr = queryRecords("www.dove.test.", dns.TypeA)
+	if len(rr) != 0 {
+		t.Errorf("large replace import should remove other records: %s", rr)
+	}
+
+	request("DELETE", "http://localhost:8080/api/v1/zone/dove.test.", nil)
+}
+
+func TestChangesets(t *testing.T) {
+	request("PUT", "http://localhost:8080/api/v1/zone/dove.test.", nil)
+	request("PUT", "http://localhost:8080/api/v1/zone/dove.test./old", []byte("old 300 IN A 192.0.2.1"))
+	requestJson("POST", "http://localhost:8080/api/v1/zone/dove.test./changes", `{
+		"put": [
+			{"id": "www", "record": "www 300 IN A 192.0.2.2"},
+			{"id": "www2", "record": "www 300 IN A 192.0.2.3", "maxAnswers": 1}
+		],
+		"delete": ["old"]
+	}`)
+	time.Sleep(2 * time.Second)
+
+	rr := queryRecords("old.dove.test.", dns.TypeA)
+	if len(rr) != 0 {
+		t.Errorf("deleted record should be gone: %s", rr)
+	}
+	rr = queryRecords("www.dove.test.", dns.TypeA)
+	if len(rr) != 1 {
+		t.Errorf("expected one answer: %s", rr)
+	}
+
+	// Invalid changes are rejected as a whole
+	req, _ := http.NewRequest("POST", "http://localhost:8080/api/v1/zone/dove.test./changes", strings.NewReader(`{
+		"put": [{"id": "mail", "record": "mail 300 IN A 192.0.2.4"}, {"id": "broken", "record": "broken IN BOGUS 1"}]
+	}`))
+	req.Header.Set("Authorization", "test-api-key")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", res.StatusCode)
+	}
+	time.Sleep(2 * time.Second)
+	rr = queryRecords("mail.dove.test.", dns.TypeA)
+	if len(rr) != 0 {
+		t.Errorf("records of rejected changeset should not exist: %s", rr)
+	}
+
+	request("DELETE", "http://localhost:8080/api/v1/zone/dove.test.", nil)
+}
+
+// conditionalRequest sends request with If-Match header, returning the
+// response status and ETag.
+func conditionalRequest(method, url string, payload string, version string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(payload))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Authorization", "test-api-key")
+	if version != "" {
+		req.Header.Set("If-Match", version)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	res.Body.Close()
+	return res.StatusCode, res.Header.Get("ETag")
+}
+
+func TestZoneVersions(t *testing.T) {
+	request("PUT", "http://localhost:8080/api/v1/zone/dove.test.", nil)
+	request("PUT", "http://localhost:8080/api/v1/zone/dove.test./www", []byte("www 300 IN A 192.0.2.1"))
+
+	status, version := conditionalRequest("GET", "http://localhost:8080/api/v1/zone/dove.test.", "", "")
+	if status != http.StatusOK || version == "" {
+		t.Fatalf("zone read should have ETag, got status %d", status)
+	}
+	var content struct {
+		Records []struct {
+			Id     string `json:"id"`
+			Record string `json:"record"`
+		} `json:"records"`
+	}
+	json.Unmarshal([]byte(request("GET", "http://localhost:8080/api/v1/zone/dove.test.", nil)), &content)
+	if len(content.Records) != 1 || content.Records[0].Id != "www" || !strings.Contains(content.Records[0].Record, "192.0.2.1") {
+		t.Errorf("unexpected zone content: %v", content)
+	}
+	_, recordVersion := conditionalRequest("GET", "http://localhost:8080/api/v1/zone/dove.test./www", "", "")
+	if recordVersion != version {
+		t.Errorf("record read should have zone version, got %s, expected %s", recordVersion, version)
+	}
+
+	// First writer wins, second one is based on outdated version
+	status, _ = conditionalRequest("PUT", "http://localhost:8080/api/v1/zone/dove.test./www", "www 300 IN A 192.0.2.2", version)
+	if status != http.StatusOK {
+		t.Errorf("write with current version failed with status %d", status)
+	}
+	status, _ = conditionalRequest("DELETE", "http://localhost:8080/api/v1/zone/dove.test./www", "", version)
+	if status != http.StatusPreconditionFailed {
+		t.Errorf("expected status 412, got %d", status)
+	}
+	status, _ = conditionalRequest("DELETE", "http://localhost:8080/api/v1/zone/dove.test.", "", version)
+	if status != http.StatusPreconditionFailed {
+		t.Errorf("expected status 412, got %d", status)
+	}
+	time.Sleep(2 * time.Second)
+	rr := queryRecords("www.dove.test.", dns.TypeA)
+	if !recordsEqual(rr, []string{"www.dove.test. 300 IN A 192.0.2.2"}) {
+		t.Errorf("incorrect record after conflicting writes: %s", rr)
+	}
+
+	// Records cannot have ids that could not be read back
+	status, _ = conditionalRequest("PUT", "http://localhost:8080/api/v1/zone/dove.test./export", "export 300 IN A 192.0.2.3", "")
+	if status != http.StatusBadRequest {
+		t.Errorf("reserved record id should be rejected, got status %d", status)
+	}
+
+	request("DELETE", "http://localhost:8080/api/v1/zone/dove.test.", nil)
+}
+
+func TestMissingEtcdEndpoints(t *testing.T) {
+	// Zones must not be served from (and pruned to) empty memory storage
+	// just because etcd was not configured
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	stopped := make(chan struct{})
+	go func() {
+		run(ctx, []string{"--dns-addr", ":5301", "--admin-addr", ":8081", "--fallback-dir", t.TempDir()})
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dove should not start without --etcd-endpoints")
+	}
+}
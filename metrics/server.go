@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// New starts a HTTP server that exposes Prometheus metrics at /metrics.
+// Given collectors are registered in addition to the metrics that dove's
+// packages register themselves.
+func New(ctx context.Context, addr string, collectors ...prometheus.Collector) {
+	for _, collector := range collectors {
+		prometheus.MustRegister(collector)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			slog.Error("metrics server failed", "error", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+}
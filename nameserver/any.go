@@ -0,0 +1,48 @@
+package nameserver
+
+import (
+	"slices"
+
+	"github.com/bensku/dove/zone"
+	"github.com/miekg/dns"
+)
+
+// Policies for answering ANY queries (RFC 8482)
+const (
+	// Answer with a single synthesized HINFO record
+	AnyHinfo = "hinfo"
+	// Answer with one of the RRsets
+	AnyRRset = "rrset"
+	// Answer with all records over TCP; UDP responses are truncated
+	AnyTcp = "tcp"
+)
+
+// TTL of synthesized HINFO answers to ANY queries
+const anyHinfoTtl = 3600
+
+// minimizeAny applies ANY policy to records that match an ANY query.
+// Clients that sign queries with transfer keys always get all records.
+func (s *Server) minimizeAny(w dns.ResponseWriter, m *dns.Msg, records []zone.DnsRecord, client *clientInfo) []zone.DnsRecord {
+	if len(records) == 0 {
+		return records // Nothing to minimize
+	}
+	if client.tsigKey != "" && slices.Contains(s.transferKeys, client.tsigKey) {
+		return records
+	}
+
+	switch s.anyPolicy {
+	case AnyRRset:
+		return groupRRsets(records)[0]
+	case AnyTcp:
+		if transport(w) == "tcp" {
+			return records
+		}
+		m.Truncated = true // Retry over TCP
+		return nil
+	default: // AnyHinfo
+		return []zone.DnsRecord{{Record: &dns.HINFO{
+			Hdr: dns.RR_Header{Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: anyHinfoTtl},
+			Cpu: "RFC8482",
+		}}}
+	}
+}
@@ -0,0 +1,64 @@
+package nameserver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/bensku/dove/zone"
+	"github.com/miekg/dns"
+)
+
+func TestAnyPolicy(t *testing.T) {
+	testZone := &zone.Zone{Name: "dove.test.", Records: []zone.DnsRecord{
+		testRecord("a1", "www 300 IN A 192.0.2.1", 0, 0),
+		testRecord("a2", "www 300 IN A 192.0.2.2", 0, 0),
+		testRecord("aaaa", "www 300 IN AAAA 2001:db8::1", 0, 0),
+		testRecord("txt", "www 300 IN TXT hello", 0, 0),
+	}}
+	udp := &net.UDPAddr{IP: net.ParseIP("192.0.2.100"), Port: 12345}
+	tcp := &net.TCPAddr{IP: udp.IP, Port: udp.Port}
+
+	cases := []struct {
+		policy    string
+		remote    net.Addr
+		tsigKey   string
+		answers   int
+		truncated bool
+	}{
+		{AnyHinfo, udp, "", 1, false},
+		{AnyHinfo, tcp, "", 1, false},
+		{AnyRRset, udp, "", 2, false},
+		{AnyTcp, udp, "", 0, true},
+		{AnyTcp, tcp, "", 4, false},
+		// Transfer clients get everything
+		{AnyHinfo, udp, "transfer-key.", 4, false},
+		{AnyHinfo, udp, "other-key.", 1, false},
+	}
+	for _, c := range cases {
+		server := &Server{zones: &zone.ZoneServer{}, anyPolicy: c.policy, transferKeys: []string{"transfer-key."}}
+		r := new(dns.Msg)
+		r.SetQuestion("www.dove.test.", dns.TypeANY)
+		if c.tsigKey != "" {
+			r.SetTsig(c.tsigKey, dns.HmacSHA256, 300, 0)
+		}
+		m := server.handleRequest(testZone, &testWriter{remote: c.remote}, r)
+
+		if len(m.Answer) != c.answers || m.Truncated != c.truncated {
+			t.Errorf("%s over %s: expected %d answers (truncated: %v), got %v", c.policy, c.remote.Network(), c.answers, c.truncated, m)
+		}
+		if c.answers == 1 {
+			hinfo, ok := m.Answer[0].(*dns.HINFO)
+			if !ok || hinfo.Cpu != "RFC8482" || hinfo.Hdr.Name != "www.dove.test." {
+				t.Errorf("expected RFC 8482 HINFO, got %v", m.Answer)
+			}
+		}
+	}
+
+	// Names without records have nothing to minimize
+	server := &Server{zones: &zone.ZoneServer{}, anyPolicy: AnyHinfo}
+	r := new(dns.Msg)
+	r.SetQuestion("nothing.dove.test.", dns.TypeANY)
+	if m := server.handleRequest(testZone, &testWriter{remote: udp}, r); len(m.Answer) != 0 {
+		t.Errorf("expected no answers, got %v", m.Answer)
+	}
+}
@@ -0,0 +1,79 @@
+package nameserver
+
+import (
+	"encoding/hex"
+	"log/slog"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ChaosOptions configures answers that identify the server. Empty values are
+// not revealed to anyone.
+type ChaosOptions struct {
+	// Answer to version.bind and version.server CHAOS TXT queries
+	Version string
+	// Answer to hostname.bind and id.server CHAOS TXT queries
+	Id string
+	// Value of EDNS NSID option (RFC 5001), sent to clients that ask for it
+	Nsid string
+}
+
+// route sends CHAOS class queries to identity handler, and everything else
+// to the zones.
+func (s *Server) route(w dns.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) == 1 && r.Question[0].Qclass == dns.ClassCHAOS {
+		m := s.handleChaos(r)
+		err := w.WriteMsg(m)
+		if err != nil {
+			slog.Debug("failed to write DNS response", "error", err)
+		}
+		return
+	}
+	s.mux.ServeDNS(w, r)
+}
+
+func (s *Server) handleChaos(r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(maxUdpSize, opt.Do())
+	}
+	s.addNsid(r, m)
+
+	q := r.Question[0]
+	var value string
+	switch strings.ToLower(q.Name) {
+	case "version.bind.", "version.server.":
+		value = s.chaos.Version
+	case "hostname.bind.", "id.server.":
+		value = s.chaos.Id
+	}
+	if value == "" {
+		m.Rcode = dns.RcodeRefused // Unknown or hidden
+		return m
+	}
+
+	m.Authoritative = true
+	if q.Qtype == dns.TypeTXT || q.Qtype == dns.TypeANY {
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+			Txt: []string{value},
+		})
+	}
+	return m
+}
+
+// addNsid adds NSID option to response if the query asked for it.
+func (s *Server) addNsid(r *dns.Msg, m *dns.Msg) {
+	opt := r.IsEdns0()
+	if opt == nil || s.chaos.Nsid == "" {
+		return
+	}
+	for _, option := range opt.Option {
+		if option.Option() == dns.EDNS0NSID {
+			addEdnsOption(m, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte(s.chaos.Nsid))})
+			return
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package nameserver
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestChaos(t *testing.T) {
+	server := &Server{chaos: ChaosOptions{Version: "dove", Id: "node1", Nsid: "node1"}}
+	cases := []struct {
+		name     string
+		expected string
+		rcode    int
+	}{
+		{"version.bind.", "dove", dns.RcodeSuccess},
+		{"VERSION.SERVER.", "dove", dns.RcodeSuccess},
+		{"hostname.bind.", "node1", dns.RcodeSuccess},
+		{"id.server.", "node1", dns.RcodeSuccess},
+		{"authors.bind.", "", dns.RcodeRefused},
+	}
+	for _, c := range cases {
+		r := new(dns.Msg)
+		r.SetQuestion(c.name, dns.TypeTXT)
+		r.Question[0].Qclass = dns.ClassCHAOS
+		m := server.handleChaos(r)
+		if m.Rcode != c.rcode {
+			t.Errorf("%s: expected rcode %d, got %d", c.name, c.rcode, m.Rcode)
+		}
+		if c.expected != "" && (len(m.Answer) != 1 || m.Answer[0].(*dns.TXT).Txt[0] != c.expected ||
+			m.Answer[0].Header().Class != dns.ClassCHAOS) {
+			t.Errorf("%s: expected %s, got %v", c.name, c.expected, m.Answer)
+		}
+	}
+
+	// Hidden values are refused
+	server.chaos.Version = ""
+	r := new(dns.Msg)
+	r.SetQuestion("version.bind.", dns.TypeTXT)
+	r.Question[0].Qclass = dns.ClassCHAOS
+	if m := server.handleChaos(r); m.Rcode != dns.RcodeRefused || len(m.Answer) != 0 {
+		t.Errorf("hidden version should be refused, got %v", m)
+	}
+
+	// NSID is only sent when asked for
+	r.SetEdns0(maxUdpSize, false)
+	m := server.handleChaos(r)
+	if len(m.IsEdns0().Option) != 0 {
+		t.Errorf("NSID was not asked for, got %v", m.IsEdns0().Option)
+	}
+	r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	m = server.handleChaos(r)
+	if len(m.IsEdns0().Option) != 1 || m.IsEdns0().Option[0].(*dns.EDNS0_NSID).Nsid != "6e6f646531" {
+		t.Errorf("expected NSID node1, got %v", m.IsEdns0().Option)
+	}
+}
@@ -0,0 +1,136 @@
+package nameserver
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+// clientInfo describes who a response is being built for.
+type clientInfo struct {
+	// Source address of query
+	remote netip.Addr
+	// Name of TSIG key the query was signed with, if any
+	tsigKey string
+	// Split-horizon view of client, empty if it has none
+	view string
+	// Result of DNS cookie validation; clients with valid server cookies
+	// have proven that they can receive packets sent to their address
+	cookie string
+
+	// Address used for choosing answers; from EDNS Client Subnet option
+	// if the query had one, otherwise source address of query
+	addr net.IP
+	// Prefix length of addr that is actually known
+	sourcePrefix uint8
+	// ECS option of query, nil if there was none
+	subnet *dns.EDNS0_SUBNET
+	// How many bits of addr the answer depends on
+	scope uint8
+}
+
+func remoteIP(w dns.ResponseWriter) net.IP {
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// newClientInfo finds out who sent the query. ECS option is used only if
+// the query came from a trusted resolver; malformed ECS options are
+// reported as errors.
+func newClientInfo(w dns.ResponseWriter, r *dns.Msg, ecs ecsPolicy) (*clientInfo, error) {
+	client := &clientInfo{addr: remoteIP(w)}
+	client.remote, _ = netip.AddrFromSlice(client.addr)
+	client.remote = client.remote.Unmap()
+	if client.addr.To4() != nil {
+		client.addr = client.addr.To4()
+	}
+	client.sourcePrefix = uint8(len(client.addr) * 8)
+
+	opt := r.IsEdns0()
+	if opt == nil || !ecs.trusts(client.remote) {
+		return client, nil
+	}
+	for _, option := range opt.Option {
+		subnet, ok := option.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+		if subnet.SourceScope != 0 {
+			return nil, fmt.Errorf("ECS scope prefix length must be 0 in queries")
+		}
+		addr, _ := netip.AddrFromSlice(subnet.Address)
+		if subnet.Family != 2 {
+			addr = addr.Unmap()
+		}
+		prefix, err := addr.Prefix(int(subnet.SourceNetmask))
+		if err != nil || prefix.Addr() != addr {
+			return nil, fmt.Errorf("ECS address has bits set beyond its prefix length")
+		}
+
+		client.subnet = subnet
+		client.sourcePrefix = subnet.SourceNetmask
+		// Prefix length 0 means that resolver does not want us to
+		// use its clients' addresses, so answer based on resolver's
+		if subnet.SourceNetmask != 0 {
+			client.addr = addr.AsSlice()
+		}
+		break
+	}
+	return client, nil
+}
+
+// ecsPolicy decides which resolvers' EDNS Client Subnet options are used.
+type ecsPolicy struct {
+	ignore bool
+	// Resolvers whose ECS options are used; empty to trust everyone
+	trusted []netip.Prefix
+}
+
+func (policy ecsPolicy) trusts(resolver netip.Addr) bool {
+	if policy.ignore {
+		return false
+	}
+	if len(policy.trusted) == 0 {
+		return true
+	}
+	for _, network := range policy.trusted {
+		if network.Contains(resolver) {
+			return true
+		}
+	}
+	return false
+}
+
+// dependsOnAddress records that the answer depends on given number of bits
+// of client address.
+func (client *clientInfo) dependsOnAddress(bits int) {
+	if bits > int(client.sourcePrefix) {
+		// We don't know more than this, and thus can't claim the answer
+		// depends on more either
+		bits = int(client.sourcePrefix)
+	}
+	if uint8(bits) > client.scope {
+		client.scope = uint8(bits)
+	}
+}
+
+// addSubnetOption echoes client's ECS option back, with scope of the answer.
+func (client *clientInfo) addSubnetOption(m *dns.Msg) {
+	if client.subnet == nil {
+		return
+	}
+	addEdnsOption(m, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        client.subnet.Family,
+		SourceNetmask: client.subnet.SourceNetmask,
+		SourceScope:   client.scope,
+		Address:       client.subnet.Address,
+	})
+}
@@ -0,0 +1,58 @@
+package nameserver
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestClientSubnet(t *testing.T) {
+	trusted := ecsPolicy{trusted: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}}
+	cases := []struct {
+		resolver string
+		policy   ecsPolicy
+		subnet   *dns.EDNS0_SUBNET
+		addr     string // Empty if query is malformed
+		used     bool
+	}{
+		{"192.0.2.1", trusted, &dns.EDNS0_SUBNET{Family: 1, SourceNetmask: 24,
+			Address: net.ParseIP("198.51.100.0")}, "198.51.100.0", true},
+		{"2001:db8::1", ecsPolicy{}, &dns.EDNS0_SUBNET{Family: 2, SourceNetmask: 56,
+			Address: net.ParseIP("2001:db8:1:200::")}, "2001:db8:1:200::", true},
+		// Untrusted resolvers and disabled ECS
+		{"203.0.113.1", trusted, &dns.EDNS0_SUBNET{Family: 1, SourceNetmask: 24,
+			Address: net.ParseIP("198.51.100.0")}, "203.0.113.1", false},
+		{"192.0.2.1", ecsPolicy{ignore: true}, &dns.EDNS0_SUBNET{Family: 1, SourceNetmask: 24,
+			Address: net.ParseIP("198.51.100.0")}, "192.0.2.1", false},
+		// Malformed options
+		{"192.0.2.1", trusted, &dns.EDNS0_SUBNET{Family: 1, SourceNetmask: 24, SourceScope: 24,
+			Address: net.ParseIP("198.51.100.0")}, "", false},
+		{"192.0.2.1", trusted, &dns.EDNS0_SUBNET{Family: 1, SourceNetmask: 16,
+			Address: net.ParseIP("198.51.100.0")}, "", false},
+	}
+	for _, c := range cases {
+		w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP(c.resolver), Port: 12345}}
+		r := new(dns.Msg)
+		r.SetQuestion("www.dove.test.", dns.TypeA)
+		r.SetEdns0(maxUdpSize, false)
+		c.subnet.Code = dns.EDNS0SUBNET
+		r.IsEdns0().Option = append(r.IsEdns0().Option, c.subnet)
+
+		client, err := newClientInfo(w, r, c.policy)
+		if c.addr == "" {
+			if err == nil {
+				t.Errorf("%v from %s should be rejected", c.subnet, c.resolver)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v from %s: %v", c.subnet, c.resolver, err)
+			continue
+		}
+		if client.addr.String() != c.addr || (client.subnet != nil) != c.used {
+			t.Errorf("%v from %s: expected address %s (ECS used: %v), got %s", c.subnet, c.resolver, c.addr, c.used, client.addr)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package nameserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net/netip"
+	"time"
+
+	"github.com/dchest/siphash"
+	"github.com/miekg/dns"
+)
+
+// CookieSecrets provides secrets for creating and validating server cookies.
+type CookieSecrets interface {
+	// Secrets returns all currently accepted secrets, one used for new
+	// cookies first. Each secret is 16 bytes long.
+	Secrets() [][]byte
+}
+
+const (
+	clientCookieLength = 8
+	// Server cookie format from RFC 9018: version, reserved bytes,
+	// timestamp and hash
+	serverCookieLength  = 16
+	serverCookieVersion = 1
+	// How long server cookies are accepted for
+	cookieLifetime = time.Hour
+	// How far in future cookie timestamps may be, for clock skew
+	cookieMaxSkew = 5 * time.Minute
+)
+
+// Results of server cookie validation
+const (
+	cookieNone    = "none"    // Query did not have cookie option
+	cookieClient  = "client"  // Only client cookie was sent
+	cookieValid   = "valid"   // Server cookie was valid
+	cookieInvalid = "invalid" // Server cookie was invalid or expired
+)
+
+// serverCookie calculates a server cookie for given client cookie and address.
+func serverCookie(secret []byte, clientCookie []byte, clientAddr netip.Addr, timestamp uint32) []byte {
+	cookie := make([]byte, serverCookieLength)
+	cookie[0] = serverCookieVersion
+	binary.BigEndian.PutUint32(cookie[4:], timestamp)
+
+	input := make([]byte, 0, clientCookieLength+8+16)
+	input = append(input, clientCookie...)
+	input = append(input, cookie[:8]...)
+	input = append(input, clientAddr.Unmap().AsSlice()...)
+	hash := siphash.New(secret)
+	hash.Write(input)
+	copy(cookie[8:], hash.Sum(nil))
+	return cookie
+}
+
+// validServerCookie checks that a server cookie was created by us for this
+// client recently.
+func validServerCookie(secrets [][]byte, clientCookie []byte, clientAddr netip.Addr, cookie []byte, now time.Time) bool {
+	if len(cookie) != serverCookieLength || cookie[0] != serverCookieVersion {
+		return false
+	}
+	timestamp := binary.BigEndian.Uint32(cookie[4:])
+	// Serial number arithmetic, as timestamps wrap around
+	age := time.Duration(int32(uint32(now.Unix())-timestamp)) * time.Second
+	if age > cookieLifetime || age < -cookieMaxSkew {
+		return false
+	}
+	for _, secret := range secrets {
+		if bytes.Equal(serverCookie(secret, clientCookie, clientAddr, timestamp), cookie) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCookie validates DNS cookie (RFC 7873) of query and adds a fresh
+// server cookie to response. Returns result of validation, and false if the
+// response should not contain an answer (malformed cookie or, on UDP,
+// invalid server cookie).
+func (s *Server) checkCookie(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg, client *clientInfo) (string, bool) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return cookieNone, true
+	}
+	var option *dns.EDNS0_COOKIE
+	for _, o := range opt.Option {
+		if cookie, ok := o.(*dns.EDNS0_COOKIE); ok {
+			option = cookie
+			break
+		}
+	}
+	if option == nil {
+		return cookieNone, true
+	}
+
+	data, err := hex.DecodeString(option.Cookie)
+	if err != nil || (len(data) != clientCookieLength && (len(data) < 16 || len(data) > 40)) {
+		m.Rcode = dns.RcodeFormatError
+		return cookieInvalid, false
+	}
+	secrets := s.cookies.Secrets()
+	if len(secrets) == 0 {
+		return cookieNone, true // Secrets not loaded yet, can't do anything
+	}
+
+	clientCookie := data[:clientCookieLength]
+	now := time.Now()
+	result := cookieClient
+	if len(data) > clientCookieLength {
+		if validServerCookie(secrets, clientCookie, client.remote, data[clientCookieLength:], now) {
+			result = cookieValid
+		} else {
+			result = cookieInvalid
+		}
+	}
+
+	fresh := serverCookie(secrets[0], clientCookie, client.remote, uint32(now.Unix()))
+	addEdnsOption(m, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(clientCookie) + hex.EncodeToString(fresh),
+	})
+	cookieResults.WithLabelValues(result).Inc()
+
+	if result == cookieInvalid && s.enforceCookies && transport(w) == "udp" {
+		// Client should retry with the new cookie; spoofed queries will not
+		m.Rcode = dns.RcodeBadCookie
+		return result, false
+	}
+	return result, true
+}
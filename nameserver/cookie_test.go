@@ -0,0 +1,109 @@
+package nameserver
+
+import (
+	"encoding/hex"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bensku/dove/zone"
+	"github.com/miekg/dns"
+)
+
+type testSecrets [][]byte
+
+func (secrets testSecrets) Secrets() [][]byte {
+	return secrets
+}
+
+func mustHex(s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func TestServerCookie(t *testing.T) {
+	// Test vector from RFC 9018 appendix A.1
+	secret := mustHex("e5e973e5a6b2a43f48e7dc849e37bfcf")
+	clientCookie := mustHex("2464c4abcf10c957")
+	addr := netip.MustParseAddr("198.51.100.100")
+	cookie := serverCookie(secret, clientCookie, addr, 1559731985)
+	if hex.EncodeToString(cookie) != "010000005cf79f111f8130c3eee29480" {
+		t.Errorf("wrong server cookie %x", cookie)
+	}
+
+	now := time.Unix(1559731985, 0)
+	if !validServerCookie([][]byte{secret}, clientCookie, addr, cookie, now) {
+		t.Error("cookie should be valid")
+	}
+	if !validServerCookie([][]byte{make([]byte, 16), secret}, clientCookie, addr, cookie, now.Add(30*time.Minute)) {
+		t.Error("cookie should be valid with previous secret")
+	}
+	if validServerCookie([][]byte{secret}, clientCookie, addr, cookie, now.Add(2*time.Hour)) {
+		t.Error("expired cookie should be invalid")
+	}
+	if validServerCookie([][]byte{secret}, clientCookie, netip.MustParseAddr("198.51.100.101"), cookie, now) {
+		t.Error("cookie of another client should be invalid")
+	}
+}
+
+func TestCookies(t *testing.T) {
+	server := &Server{zones: &zone.ZoneServer{}, cookies: testSecrets{mustHex("e5e973e5a6b2a43f48e7dc849e37bfcf")}}
+	testZone := &zone.Zone{Name: "dove.test.", Records: []zone.DnsRecord{
+		testRecord("www", "www 300 IN A 192.0.2.1", 0, 0),
+	}}
+	query := func(cookie string, remote net.Addr) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("www.dove.test.", dns.TypeA)
+		r.SetEdns0(maxUdpSize, false)
+		r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+		return server.handleRequest(testZone, &testWriter{remote: remote}, r)
+	}
+	udp := &net.UDPAddr{IP: net.ParseIP("198.51.100.100"), Port: 12345}
+
+	// Client cookie only: answer, and give server cookie
+	m := query("2464c4abcf10c957", udp)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+		t.Fatal("query with client cookie should be answered", m)
+	}
+	given := m.IsEdns0().Option[0].(*dns.EDNS0_COOKIE).Cookie
+	if len(given) != 48 || given[:16] != "2464c4abcf10c957" {
+		t.Fatal("expected client and server cookie, got", given)
+	}
+
+	// Valid server cookie
+	m = query(given, udp)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+		t.Error("query with valid server cookie should be answered", m)
+	}
+
+	// Invalid server cookie, answered like client cookie only by default
+	invalid := given[:40] + "00000000"
+	m = query(invalid, udp)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+		t.Error("invalid server cookie should be answered", m)
+	}
+	if fresh := m.IsEdns0().Option[0].(*dns.EDNS0_COOKIE).Cookie; fresh == invalid {
+		t.Error("invalid server cookie should be replaced")
+	}
+
+	// If cookies are enforced, refused on UDP but not on TCP
+	server.enforceCookies = true
+	m = query(invalid, udp)
+	if m.Rcode != dns.RcodeBadCookie || len(m.Answer) != 0 {
+		t.Error("invalid server cookie should get BADCOOKIE", m)
+	}
+	m = query(invalid, &net.TCPAddr{IP: udp.IP, Port: udp.Port})
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+		t.Error("invalid server cookie should be ignored over TCP", m)
+	}
+
+	// Malformed cookie
+	m = query("2464c4ab", udp)
+	if m.Rcode != dns.RcodeFormatError {
+		t.Error("malformed cookie should get FORMERR", m)
+	}
+}
@@ -0,0 +1,89 @@
+package nameserver
+
+import (
+	"net/netip"
+
+	"github.com/bensku/dove/zone"
+	"github.com/miekg/dns"
+)
+
+// embedIPv4 maps an IPv4 address into NAT64 prefix as described in RFC 6052.
+// Bits 64-71 of the address are reserved and always zero.
+func embedIPv4(prefix netip.Prefix, v4 netip.Addr) netip.Addr {
+	addr := prefix.Masked().Addr().As16()
+	pos := prefix.Bits() / 8
+	for _, octet := range v4.As4() {
+		if pos == 8 {
+			pos++ // Skip the u-octet
+		}
+		addr[pos] = octet
+		pos++
+	}
+	return netip.AddrFrom16(addr)
+}
+
+func containsAddr(networks []netip.Prefix, addr netip.Addr) bool {
+	for _, network := range networks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// inDns64Networks checks if client should get synthesized AAAA records.
+// Since the answer depends on client address, ECS scope is updated.
+func inDns64Networks(config *zone.Dns64, client *clientInfo) bool {
+	longest := 0
+	for _, network := range config.ClientNetworks {
+		longest = max(longest, network.Bits())
+	}
+	client.dependsOnAddress(longest)
+
+	addr, ok := netip.AddrFromSlice(client.addr)
+	return ok && containsAddr(config.ClientNetworks, addr.Unmap())
+}
+
+// applyDns64 replaces answer to AAAA query with synthesized AAAA records if
+// the name has A records, but no AAAA records outside of excluded networks.
+func (s *Server) applyDns64(config *zone.Dns64, zoneId string, zoneRecords []zone.DnsRecord,
+	name string, answer []zone.DnsRecord, client *clientInfo) []zone.DnsRecord {
+	if !inDns64Networks(config, client) {
+		return answer
+	}
+
+	real := make([]zone.DnsRecord, 0, len(answer))
+	for _, record := range answer {
+		if aaaa, ok := record.Record.(*dns.AAAA); ok {
+			addr, _ := netip.AddrFromSlice(aaaa.AAAA)
+			if containsAddr(config.Exclude, addr) {
+				continue
+			}
+		}
+		real = append(real, record)
+	}
+	if len(real) != 0 {
+		return real
+	}
+
+	prefix := config.Nat64Prefix()
+	v4Records := s.selectRecords(zoneId, matchRecords(zoneRecords, name, dns.TypeA, client.view), client)
+	synthesized := make([]zone.DnsRecord, 0, len(v4Records))
+	for _, record := range v4Records {
+		a, ok := record.Record.(*dns.A)
+		if !ok {
+			continue
+		}
+		v4, _ := netip.AddrFromSlice(a.A.To4())
+		if containsAddr(config.Exclude, v4) {
+			continue
+		}
+		hdr := *a.Header()
+		hdr.Rrtype = dns.TypeAAAA
+		synthesized = append(synthesized, zone.DnsRecord{Record: &dns.AAAA{
+			Hdr:  hdr,
+			AAAA: embedIPv4(prefix, v4).AsSlice(),
+		}})
+	}
+	return synthesized
+}
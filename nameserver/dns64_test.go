@@ -0,0 +1,70 @@
+package nameserver
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/bensku/dove/zone"
+	"github.com/miekg/dns"
+)
+
+func TestEmbedIPv4(t *testing.T) {
+	// Examples from RFC 6052 section 2.4
+	cases := map[string]string{
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+		"2001:db8:122:344::/96": "2001:db8:122:344::192.0.2.33",
+	}
+	v4 := netip.MustParseAddr("192.0.2.33")
+	for prefix, expected := range cases {
+		addr := embedIPv4(netip.MustParsePrefix(prefix), v4)
+		if addr != netip.MustParseAddr(expected) {
+			t.Errorf("%s: expected %s, got %s", prefix, expected, addr)
+		}
+	}
+}
+
+func TestDns64(t *testing.T) {
+	server := &Server{zones: &zone.ZoneServer{}}
+	testZone := &zone.Zone{Name: "dove.test.", Config: zone.ZoneConfig{Dns64: &zone.Dns64{
+		ClientNetworks: []netip.Prefix{netip.MustParsePrefix("2001:db8:1::/48")},
+		Exclude:        []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("::ffff:0:0/96")},
+	}}, Records: []zone.DnsRecord{
+		testRecord("v4", "v4only 300 IN A 192.0.2.1", 0, 0),
+		testRecord("dual4", "dual 300 IN A 192.0.2.2", 0, 0),
+		testRecord("dual6", "dual 300 IN AAAA 2001:db8::2", 0, 0),
+		testRecord("mapped4", "mapped 300 IN A 192.0.2.3", 0, 0),
+		testRecord("mapped6", "mapped 300 IN AAAA ::ffff:192.0.2.3", 0, 0),
+		testRecord("private", "private 300 IN A 10.0.0.1", 0, 0),
+	}}
+
+	cases := []struct {
+		client   string
+		name     string
+		expected string
+	}{
+		{"2001:db8:1::1", "v4only", "64:ff9b::c000:201"},
+		{"2001:db8:1::1", "dual", "2001:db8::2"},
+		{"2001:db8:1::1", "mapped", "64:ff9b::c000:203"},
+		{"2001:db8:1::1", "private", ""},
+		{"2001:db8:2::1", "v4only", ""},
+	}
+	for _, c := range cases {
+		w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP(c.client), Port: 12345}}
+		r := new(dns.Msg)
+		r.SetQuestion(c.name+".dove.test.", dns.TypeAAAA)
+		m := server.handleRequest(testZone, w, r)
+
+		var answers []string
+		for _, rr := range m.Answer {
+			answers = append(answers, rr.(*dns.AAAA).AAAA.String())
+		}
+		if c.expected == "" && len(answers) != 0 || c.expected != "" && (len(answers) != 1 || answers[0] != c.expected) {
+			t.Errorf("%s from %s: expected %q, got %v", c.name, c.client, c.expected, answers)
+		}
+	}
+}
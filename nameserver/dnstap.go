@@ -0,0 +1,197 @@
+package nameserver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/protobuf/proto"
+)
+
+// How many queries can wait for dnstap encoding before new ones are dropped
+const dnstapQueueSize = 10000
+
+var dnstapDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "dove_dnstap_dropped_total",
+	Help: "Queries that were not logged to dnstap because the output could not keep up.",
+})
+
+type DnstapOptions struct {
+	// Path of Unix socket that a dnstap collector listens on
+	Socket string
+	// Path of file to write dnstap data to, used if socket is not set
+	File string
+	// Fraction of queries logged, from 0 to 1
+	SampleRate float64
+	// Zones to log queries for, all zones if empty
+	Zones []string
+	// Server identity included in dnstap messages
+	Identity string
+}
+
+// Enabled checks if dnstap output has been configured.
+func (opts DnstapOptions) Enabled() bool {
+	return opts.Socket != "" || opts.File != ""
+}
+
+type dnstapEvent struct {
+	zone       string
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	query      *dns.Msg
+	response   *dns.Msg
+	queryTime  time.Time
+	respTime   time.Time
+}
+
+type dnstapLogger struct {
+	opts   DnstapOptions
+	output dnstap.Output
+	events chan dnstapEvent
+	done   chan struct{}
+}
+
+func newDnstapLogger(ctx context.Context, opts DnstapOptions) (*dnstapLogger, error) {
+	var output dnstap.Output
+	var err error
+	if opts.Socket != "" {
+		output, err = dnstap.NewFrameStreamSockOutput(&net.UnixAddr{Name: opts.Socket, Net: "unix"})
+	} else {
+		output, err = dnstap.NewFrameStreamOutputFromFilename(opts.File)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dnstap output: %v", err)
+	}
+
+	logger := &dnstapLogger{
+		opts:   opts,
+		output: output,
+		events: make(chan dnstapEvent, dnstapQueueSize),
+		done:   make(chan struct{}),
+	}
+	go output.RunOutputLoop()
+	go logger.run(ctx)
+	return logger, nil
+}
+
+// log queues a query and its response for dnstap output. It never blocks;
+// if the output falls behind, events are dropped instead.
+func (l *dnstapLogger) log(zoneName string, w dns.ResponseWriter, r *dns.Msg, m *dns.Msg, queryTime time.Time) {
+	if len(l.opts.Zones) != 0 && !slices.Contains(l.opts.Zones, zoneName) {
+		return
+	}
+	if l.opts.SampleRate < 1 && rand.Float64() >= l.opts.SampleRate {
+		return
+	}
+
+	select {
+	case l.events <- dnstapEvent{
+		zone:       zoneName,
+		remoteAddr: w.RemoteAddr(),
+		localAddr:  w.LocalAddr(),
+		query:      r,
+		response:   m,
+		queryTime:  queryTime,
+		respTime:   time.Now(),
+	}:
+	default:
+		dnstapDropped.Inc()
+	}
+}
+
+func (l *dnstapLogger) run(ctx context.Context) {
+	outputCh := l.output.GetOutputChannel()
+	for {
+		select {
+		case event := <-l.events:
+			for _, msgType := range []dnstap.Message_Type{dnstap.Message_AUTH_QUERY, dnstap.Message_AUTH_RESPONSE} {
+				frame, err := l.encode(event, msgType)
+				if err != nil {
+					slog.Debug("failed to encode dnstap message", "error", err)
+					continue
+				}
+				outputCh <- frame
+			}
+		case <-ctx.Done():
+			l.output.Close() // Flushes pending output
+			close(l.done)
+			return
+		}
+	}
+}
+
+func (l *dnstapLogger) encode(event dnstapEvent, msgType dnstap.Message_Type) ([]byte, error) {
+	msg := &dnstap.Message{
+		Type:          &msgType,
+		QueryTimeSec:  proto.Uint64(uint64(event.queryTime.Unix())),
+		QueryTimeNsec: proto.Uint32(uint32(event.queryTime.Nanosecond())),
+	}
+
+	// Addresses and transport
+	protocol := dnstap.SocketProtocol_UDP
+	var queryAddr, respAddr net.IP
+	var queryPort, respPort int
+	switch addr := event.remoteAddr.(type) {
+	case *net.UDPAddr:
+		queryAddr, queryPort = addr.IP, addr.Port
+	case *net.TCPAddr:
+		protocol = dnstap.SocketProtocol_TCP
+		queryAddr, queryPort = addr.IP, addr.Port
+	}
+	switch addr := event.localAddr.(type) {
+	case *net.UDPAddr:
+		respAddr, respPort = addr.IP, addr.Port
+	case *net.TCPAddr:
+		respAddr, respPort = addr.IP, addr.Port
+	}
+	family := dnstap.SocketFamily_INET6
+	if queryAddr.To4() != nil {
+		family = dnstap.SocketFamily_INET
+		queryAddr = queryAddr.To4()
+		respAddr = respAddr.To4()
+	}
+	msg.SocketFamily = &family
+	msg.SocketProtocol = &protocol
+	msg.QueryAddress = queryAddr
+	msg.QueryPort = proto.Uint32(uint32(queryPort))
+	msg.ResponseAddress = respAddr
+	msg.ResponsePort = proto.Uint32(uint32(respPort))
+
+	zoneName := make([]byte, 255)
+	end, err := dns.PackDomainName(event.zone, zoneName, 0, nil, false)
+	if err == nil {
+		msg.QueryZone = zoneName[:end]
+	}
+
+	// Query is included in both messages, response only after it was sent
+	query, err := event.query.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack query: %v", err)
+	}
+	msg.QueryMessage = query
+	if msgType == dnstap.Message_AUTH_RESPONSE {
+		response, err := event.response.Pack()
+		if err != nil {
+			return nil, fmt.Errorf("failed to pack response: %v", err)
+		}
+		msg.ResponseMessage = response
+		msg.ResponseTimeSec = proto.Uint64(uint64(event.respTime.Unix()))
+		msg.ResponseTimeNsec = proto.Uint32(uint32(event.respTime.Nanosecond()))
+	}
+
+	dtType := dnstap.Dnstap_MESSAGE
+	return proto.Marshal(&dnstap.Dnstap{
+		Type:     &dtType,
+		Identity: []byte(l.opts.Identity),
+		Version:  []byte("dove"),
+		Message:  msg,
+	})
+}
@@ -0,0 +1,134 @@
+package nameserver
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bensku/dove/zone"
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/protobuf/proto"
+)
+
+func dnstapQuery() (*testWriter, *dns.Msg, *dns.Msg) {
+	w := &testWriter{remote: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 12345}}
+	r := new(dns.Msg)
+	r.SetQuestion("www.dove.test.", dns.TypeA)
+	m := new(dns.Msg)
+	m.SetReply(r)
+	rr, _ := dns.NewRR("www.dove.test. 300 IN A 1.2.3.4")
+	m.Answer = append(m.Answer, rr)
+	return w, r, m
+}
+
+func TestDnstap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	logger, err := newDnstapLogger(ctx, DnstapOptions{File: path, SampleRate: 1, Identity: "node1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, r, m := dnstapQuery()
+	logger.log("dove.test.", w, r, m, time.Now())
+	time.Sleep(100 * time.Millisecond) // Let the event be encoded before stopping
+	cancelFunc()
+	<-logger.done
+
+	input, err := dnstap.NewFrameStreamInputFromFilename(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := make(chan []byte, 10)
+	input.ReadInto(frames)
+	close(frames)
+
+	// Query and response are logged separately
+	var types []dnstap.Message_Type
+	for frame := range frames {
+		var message dnstap.Dnstap
+		err = proto.Unmarshal(frame, &message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(message.Identity) != "node1" {
+			t.Errorf("expected identity node1, got %s", message.Identity)
+		}
+		msg := message.Message
+		types = append(types, msg.GetType())
+		if !net.IP(msg.QueryAddress).Equal(net.IPv4(192, 0, 2, 1)) || msg.GetQueryPort() != 12345 {
+			t.Errorf("unexpected query address %v:%d", net.IP(msg.QueryAddress), msg.GetQueryPort())
+		}
+		if msg.GetSocketProtocol() != dnstap.SocketProtocol_UDP || msg.GetSocketFamily() != dnstap.SocketFamily_INET {
+			t.Errorf("unexpected transport %v %v", msg.GetSocketFamily(), msg.GetSocketProtocol())
+		}
+		zoneName, _, err := dns.UnpackDomainName(msg.QueryZone, 0)
+		if err != nil || zoneName != "dove.test." {
+			t.Errorf("unexpected zone %s", zoneName)
+		}
+		if (msg.GetType() == dnstap.Message_AUTH_RESPONSE) != (msg.ResponseMessage != nil) {
+			t.Errorf("only responses should contain response message")
+		}
+	}
+	if len(types) != 2 || types[0] != dnstap.Message_AUTH_QUERY || types[1] != dnstap.Message_AUTH_RESPONSE {
+		t.Fatal("expected query and response, got", types)
+	}
+}
+
+func TestDnstapFiltering(t *testing.T) {
+	w, r, m := dnstapQuery()
+	cases := []struct {
+		opts   DnstapOptions
+		logged bool
+	}{
+		{DnstapOptions{SampleRate: 1}, true},
+		{DnstapOptions{SampleRate: 0}, false},
+		{DnstapOptions{SampleRate: 1, Zones: []string{"dove.test."}}, true},
+		{DnstapOptions{SampleRate: 1, Zones: []string{"other.test."}}, false},
+	}
+	for _, c := range cases {
+		// Without output, events stay queued
+		logger := &dnstapLogger{opts: c.opts, events: make(chan dnstapEvent, 100)}
+		for range 100 {
+			logger.log("dove.test.", w, r, m, time.Now())
+		}
+		if c.logged && len(logger.events) != 100 {
+			t.Errorf("%+v: expected all queries to be logged, got %d", c.opts, len(logger.events))
+		} else if !c.logged && len(logger.events) != 0 {
+			t.Errorf("%+v: expected no queries to be logged, got %d", c.opts, len(logger.events))
+		}
+	}
+}
+
+func TestDnstapSlowOutput(t *testing.T) {
+	w, r, _ := dnstapQuery()
+	// Output is stuck, so queue is never emptied
+	logger := &dnstapLogger{opts: DnstapOptions{SampleRate: 1}, events: make(chan dnstapEvent, 1)}
+	server := &Server{zones: &zone.ZoneServer{}, dnstap: logger}
+	testZone := &zone.Zone{Name: "dove.test.", Records: []zone.DnsRecord{
+		testRecord("www", "www 300 IN A 192.0.2.1", 0, 0),
+	}}
+	dropped := testutil.ToFloat64(dnstapDropped)
+
+	served := make(chan struct{})
+	go func() {
+		for range 10 {
+			server.serveZone(testZone, w, r)
+		}
+		close(served)
+	}()
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("queries should be answered even if dnstap output is slow")
+	}
+	if len(logger.events) != 1 {
+		t.Errorf("expected one queued event, got %d", len(logger.events))
+	}
+	if testutil.ToFloat64(dnstapDropped)-dropped != 9 {
+		t.Errorf("expected 9 dropped events, got %v", testutil.ToFloat64(dnstapDropped)-dropped)
+	}
+}
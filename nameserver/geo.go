@@ -0,0 +1,177 @@
+package nameserver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bensku/dove/zone"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// How often GeoIP database file is checked for changes
+const geoReloadInterval = 10 * time.Second
+
+// Location of a client, as far as GeoIP database knows.
+type Location struct {
+	Country   string
+	Continent string
+	// Prefix length of the network that location applies to
+	PrefixLength int
+}
+
+// GeoLocator finds out where clients are.
+type GeoLocator interface {
+	Locate(ip net.IP) (Location, bool)
+}
+
+// Fields we need from MaxMind-format (e.g. GeoLite2 Country) databases
+type mmdbRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+}
+
+// GeoDatabase looks up client locations from a local MMDB file. The file
+// is reloaded when it changes on disk.
+type GeoDatabase struct {
+	path string
+
+	mutex   sync.RWMutex
+	reader  *maxminddb.Reader
+	modTime time.Time
+	size    int64
+}
+
+func OpenGeoDatabase(ctx context.Context, path string) (*GeoDatabase, error) {
+	db := &GeoDatabase{path: path}
+	err := db.reload()
+	if err != nil {
+		return nil, err
+	}
+	go db.watch(ctx)
+	return db, nil
+}
+
+func (db *GeoDatabase) reload() error {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return fmt.Errorf("failed to stat GeoIP database: %v", err)
+	}
+	db.mutex.RLock()
+	unchanged := info.ModTime().Equal(db.modTime) && info.Size() == db.size
+	db.mutex.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	reader, err := maxminddb.Open(db.path)
+	if err != nil {
+		return fmt.Errorf("failed to open GeoIP database: %v", err)
+	}
+	db.mutex.Lock()
+	old := db.reader
+	db.reader = reader
+	db.modTime = info.ModTime()
+	db.size = info.Size()
+	db.mutex.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	slog.Info("loaded GeoIP database", "path", db.path, "type", reader.Metadata.DatabaseType,
+		"built", time.Unix(int64(reader.Metadata.BuildEpoch), 0))
+	return nil
+}
+
+func (db *GeoDatabase) watch(ctx context.Context) {
+	ticker := time.NewTicker(geoReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := db.reload()
+			if err != nil {
+				slog.Error("failed to reload GeoIP database, using previous version", "error", err)
+			}
+		case <-ctx.Done():
+			db.mutex.Lock()
+			db.reader.Close()
+			db.reader = nil
+			db.mutex.Unlock()
+			return
+		}
+	}
+}
+
+func (db *GeoDatabase) Locate(ip net.IP) (Location, bool) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.reader == nil {
+		return Location{}, false
+	}
+
+	var record mmdbRecord
+	network, ok, err := db.reader.LookupNetwork(ip, &record)
+	if err != nil || !ok {
+		return Location{}, false
+	}
+	prefixLength, _ := network.Mask.Size()
+	return Location{
+		Country:      record.Country.IsoCode,
+		Continent:    record.Continent.Code,
+		PrefixLength: prefixLength,
+	}, true
+}
+
+func hasGeoTags(record zone.DnsRecord) bool {
+	return len(record.Countries) != 0 || len(record.Continents) != 0
+}
+
+// filterByLocation picks records closest to client from each RRset that
+// has records tagged with locations. Records tagged with client's country
+// are preferred, then records tagged with client's continent, and finally
+// records without tags.
+func filterByLocation(records []zone.DnsRecord, location Location, located bool) []zone.DnsRecord {
+	if !slices.ContainsFunc(records, hasGeoTags) {
+		return records // Nothing to choose from
+	}
+
+	matchers := []func(zone.DnsRecord) bool{
+		func(record zone.DnsRecord) bool {
+			return located && slices.Contains(record.Countries, location.Country)
+		},
+		func(record zone.DnsRecord) bool {
+			return located && slices.Contains(record.Continents, location.Continent)
+		},
+		func(record zone.DnsRecord) bool {
+			return !hasGeoTags(record)
+		},
+	}
+	selected := make([]zone.DnsRecord, 0, len(records))
+	for _, rrset := range groupRRsets(records) {
+		var matches []zone.DnsRecord
+		for _, matcher := range matchers {
+			for _, record := range rrset {
+				if matcher(record) {
+					matches = append(matches, record)
+				}
+			}
+			if len(matches) != 0 {
+				break
+			}
+		}
+		if len(matches) == 0 {
+			matches = rrset // Nothing close, but something is better than nothing
+		}
+		selected = append(selected, matches...)
+	}
+	return selected
+}
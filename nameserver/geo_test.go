@@ -0,0 +1,84 @@
+package nameserver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/bensku/dove/zone"
+	"github.com/miekg/dns"
+)
+
+type testLocator map[string]Location
+
+func (locator testLocator) Locate(ip net.IP) (Location, bool) {
+	location, ok := locator[ip.String()]
+	return location, ok
+}
+
+func geoRecord(id string, rr string, countries []string, continents []string) zone.DnsRecord {
+	record := testRecord(id, rr, 0, 0)
+	record.Countries = countries
+	record.Continents = continents
+	return record
+}
+
+func TestGeoSelection(t *testing.T) {
+	records := []zone.DnsRecord{
+		geoRecord("fi", "www 300 IN A 192.0.2.1", []string{"FI"}, nil),
+		geoRecord("eu", "www 300 IN A 192.0.2.2", nil, []string{"EU"}),
+		geoRecord("default", "www 300 IN A 192.0.2.3", nil, nil),
+		geoRecord("v6", "www 300 IN AAAA 2001:db8::1", nil, nil),
+	}
+	server := &Server{geo: testLocator{
+		"198.51.100.0": {Country: "FI", Continent: "EU", PrefixLength: 16},
+		"198.51.101.1": {Country: "SE", Continent: "EU", PrefixLength: 24},
+		"203.0.113.1":  {Country: "US", Continent: "NA", PrefixLength: 24},
+	}}
+
+	cases := []struct {
+		client   string
+		subnet   *dns.EDNS0_SUBNET
+		expected string
+		scope    uint8
+	}{
+		{"198.51.101.1", nil, "eu", 0},
+		{"203.0.113.1", nil, "default", 0},
+		{"192.0.2.100", nil, "default", 0},
+		// Location of resolver's client is used instead of resolver
+		{"203.0.113.1", &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24,
+			Address: net.ParseIP("198.51.100.0").To4()}, "fi", 16},
+		// Resolver asked us not to use its clients' addresses
+		{"203.0.113.1", &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 0,
+			Address: net.IPv4zero.To4()}, "default", 0},
+	}
+	for _, c := range cases {
+		w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP(c.client), Port: 12345}}
+		r := new(dns.Msg)
+		r.SetQuestion("www.dove.test.", dns.TypeANY)
+		if c.subnet != nil {
+			r.SetEdns0(maxUdpSize, false)
+			r.IsEdns0().Option = append(r.IsEdns0().Option, c.subnet)
+		}
+
+		client, err := newClientInfo(w, r, server.ecs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		selected := server.selectRecords("dove.test.", records, client)
+		if len(selected) != 2 || selected[0].Id != c.expected || selected[1].Id != "v6" {
+			t.Errorf("client %s: expected %s and v6, got %v", c.client, c.expected, selected)
+		}
+		if c.subnet == nil {
+			continue
+		}
+
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.SetEdns0(maxUdpSize, false)
+		client.addSubnetOption(m)
+		subnet, ok := m.IsEdns0().Option[0].(*dns.EDNS0_SUBNET)
+		if !ok || subnet.SourceScope != c.scope || subnet.SourceNetmask != c.subnet.SourceNetmask {
+			t.Errorf("client %s: expected ECS scope %d, got %v", c.client, c.scope, m.IsEdns0().Option)
+		}
+	}
+}
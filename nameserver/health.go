@@ -0,0 +1,33 @@
+package nameserver
+
+import "github.com/bensku/dove/zone"
+
+// RecordHealth tells which records are currently healthy.
+type RecordHealth interface {
+	Healthy(zoneId string, recordId string) bool
+}
+
+// filterHealthy removes unhealthy records from answer. If every record of
+// a RRset is unhealthy, all of them are returned; answering with something
+// that might work is better than answering with nothing.
+func filterHealthy(zoneId string, records []zone.DnsRecord, health RecordHealth) []zone.DnsRecord {
+	healthy := make([]zone.DnsRecord, 0, len(records))
+	anyHealthy := make(map[uint16]bool)
+	for _, record := range records {
+		if record.HealthCheck == nil || health.Healthy(zoneId, record.Id) {
+			healthy = append(healthy, record)
+			anyHealthy[record.Record.Header().Rrtype] = true
+		}
+	}
+	if len(healthy) == len(records) {
+		return records
+	}
+
+	// Fail open for RRsets where nothing is healthy
+	for _, record := range records {
+		if !anyHealthy[record.Record.Header().Rrtype] {
+			healthy = append(healthy, record)
+		}
+	}
+	return healthy
+}
@@ -0,0 +1,133 @@
+package nameserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Level that turns query logging off completely
+const queryLogOff = slog.Level(100)
+
+// QueryLogConfig contains query log settings that can be changed at runtime.
+type QueryLogConfig struct {
+	// Queries are logged at INFO level, with answer records included at
+	// DEBUG level. Anything higher (e.g. WARN or OFF) disables query log.
+	Level string `json:"level"`
+	// Fraction of queries logged, from 0 to 1
+	SampleRate float64 `json:"sampleRate"`
+	// Zones to log queries for, all zones if empty
+	Zones []string `json:"zones"`
+}
+
+// QueryLog writes one JSON line per DNS query.
+type QueryLog struct {
+	logger *slog.Logger
+	level  *slog.LevelVar
+
+	mutex  sync.RWMutex
+	config QueryLogConfig
+}
+
+func parseQueryLogLevel(level string) (slog.Level, error) {
+	if strings.EqualFold(level, "OFF") {
+		return queryLogOff, nil
+	}
+	var parsed slog.Level
+	err := parsed.UnmarshalText([]byte(level))
+	if err != nil {
+		return 0, fmt.Errorf("invalid query log level: %v", err)
+	}
+	return parsed, nil
+}
+
+// NewQueryLog creates a query log that writes to given output.
+func NewQueryLog(output io.Writer, config QueryLogConfig) (*QueryLog, error) {
+	level := new(slog.LevelVar)
+	log := &QueryLog{
+		logger: slog.New(slog.NewJSONHandler(output, &slog.HandlerOptions{Level: level})),
+		level:  level,
+	}
+	err := log.SetConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+// Config returns current query log configuration.
+func (l *QueryLog) Config() QueryLogConfig {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.config
+}
+
+// SetConfig replaces query log configuration. Changes take effect
+// immediately for new queries.
+func (l *QueryLog) SetConfig(config QueryLogConfig) error {
+	level, err := parseQueryLogLevel(config.Level)
+	if err != nil {
+		return err
+	}
+	if config.SampleRate < 0 || config.SampleRate > 1 {
+		return fmt.Errorf("sample rate must be between 0 and 1, got %f", config.SampleRate)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.config = config
+	l.level.Set(level)
+	return nil
+}
+
+func (l *QueryLog) log(zoneName string, w dns.ResponseWriter, r *dns.Msg, m *dns.Msg, latency time.Duration) {
+	ctx := context.Background()
+	if !l.logger.Enabled(ctx, slog.LevelInfo) {
+		return // Cheap check before taking locks
+	}
+	l.mutex.RLock()
+	sampleRate := l.config.SampleRate
+	zoneEnabled := len(l.config.Zones) == 0 || slices.Contains(l.config.Zones, zoneName)
+	l.mutex.RUnlock()
+	if !zoneEnabled || (sampleRate < 1 && rand.Float64() >= sampleRate) {
+		return
+	}
+
+	var client string
+	if host, _, err := net.SplitHostPort(w.RemoteAddr().String()); err == nil {
+		client = host
+	}
+	var qname, qtype string
+	if len(r.Question) > 0 {
+		qname = r.Question[0].Name
+		qtype = dns.TypeToString[r.Question[0].Qtype]
+	}
+	attrs := []slog.Attr{
+		slog.String("client", client),
+		slog.String("qname", qname),
+		slog.String("qtype", qtype),
+		slog.String("rcode", dns.RcodeToString[m.Rcode]),
+		slog.Int("answers", len(m.Answer)),
+		slog.String("zone", zoneName),
+		slog.String("transport", transport(w)),
+		slog.Float64("latencyMs", float64(latency.Microseconds())/1000),
+	}
+	if l.logger.Enabled(ctx, slog.LevelDebug) {
+		answers := make([]string, len(m.Answer))
+		for i, rr := range m.Answer {
+			answers[i] = rr.String()
+		}
+		l.logger.LogAttrs(ctx, slog.LevelDebug, "query", append(attrs, slog.Any("answer", answers))...)
+	} else {
+		l.logger.LogAttrs(ctx, slog.LevelInfo, "query", attrs...)
+	}
+}
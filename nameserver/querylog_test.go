@@ -0,0 +1,105 @@
+package nameserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Minimal ResponseWriter for calling handlers without network
+type testWriter struct {
+	dns.ResponseWriter
+	remote  net.Addr
+	tsigErr error
+}
+
+func (w *testWriter) TsigStatus() error {
+	return w.tsigErr
+}
+
+func (w *testWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func (w *testWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *testWriter) WriteMsg(m *dns.Msg) error {
+	return nil
+}
+
+func TestQueryLog(t *testing.T) {
+	var output bytes.Buffer
+	queryLog, err := NewQueryLog(&output, QueryLogConfig{Level: "OFF", SampleRate: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &testWriter{remote: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 12345}}
+	r := new(dns.Msg)
+	r.SetQuestion("www.dove.test.", dns.TypeA)
+	m := new(dns.Msg)
+	m.SetReply(r)
+	rr, _ := dns.NewRR("www.dove.test. 300 IN A 1.2.3.4")
+	m.Answer = append(m.Answer, rr)
+
+	// Disabled by default
+	queryLog.log("dove.test.", w, r, m, time.Millisecond)
+	if output.Len() != 0 {
+		t.Fatal("query log should be disabled", output.String())
+	}
+
+	// Enable at runtime
+	err = queryLog.SetConfig(QueryLogConfig{Level: "INFO", SampleRate: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queryLog.log("dove.test.", w, r, m, 1500*time.Microsecond)
+	var entry map[string]any
+	err = json.Unmarshal(output.Bytes(), &entry)
+	if err != nil {
+		t.Fatal(err, output.String())
+	}
+	expected := map[string]any{
+		"msg":       "query",
+		"client":    "192.0.2.1",
+		"qname":     "www.dove.test.",
+		"qtype":     "A",
+		"rcode":     "NOERROR",
+		"answers":   1.0,
+		"zone":      "dove.test.",
+		"transport": "udp",
+		"latencyMs": 1.5,
+	}
+	for key, value := range expected {
+		if entry[key] != value {
+			t.Errorf("expected %s to be %v, got %v", key, value, entry[key])
+		}
+	}
+	if _, ok := entry["answer"]; ok {
+		t.Error("answer records should only be logged at DEBUG level")
+	}
+
+	// Zone filtering and sampling
+	output.Reset()
+	queryLog.SetConfig(QueryLogConfig{Level: "INFO", SampleRate: 1, Zones: []string{"other.test."}})
+	queryLog.log("dove.test.", w, r, m, time.Millisecond)
+	queryLog.SetConfig(QueryLogConfig{Level: "INFO", SampleRate: 0})
+	queryLog.log("dove.test.", w, r, m, time.Millisecond)
+	if output.Len() != 0 {
+		t.Fatal("query should have been filtered out", output.String())
+	}
+
+	// Invalid settings are rejected
+	if queryLog.SetConfig(QueryLogConfig{Level: "LOUD", SampleRate: 1}) == nil {
+		t.Error("invalid level should be rejected")
+	}
+	if queryLog.SetConfig(QueryLogConfig{Level: "INFO", SampleRate: 2}) == nil {
+		t.Error("invalid sample rate should be rejected")
+	}
+}
@@ -0,0 +1,160 @@
+package nameserver
+
+import (
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bensku/dove/zone"
+	"github.com/miekg/dns"
+)
+
+// A name that points to an address, found from A or AAAA record
+type forwardName struct {
+	name   string // Fully qualified
+	zoneId string
+	record zone.DnsRecord
+}
+
+// reverseIndex maps addresses to names that point to them.
+type reverseIndex map[netip.Addr][]forwardName
+
+// fqdn makes a record name (relative to zone) fully qualified.
+func fqdn(name string, zoneId string) string {
+	if name == "." || name == "@" {
+		return zoneId
+	}
+	return name + zoneId
+}
+
+func buildReverseIndex(zones []*zone.Zone) reverseIndex {
+	index := make(reverseIndex)
+	for _, z := range zones {
+		for _, record := range z.Records {
+			var addr netip.Addr
+			switch rr := record.Record.(type) {
+			case *dns.A:
+				addr, _ = netip.AddrFromSlice(rr.A.To4())
+			case *dns.AAAA:
+				addr, _ = netip.AddrFromSlice(rr.AAAA)
+			default:
+				continue
+			}
+			name := record.Record.Header().Name
+			if strings.HasPrefix(name, "*") || !addr.IsValid() {
+				continue // Wildcards don't name any specific host
+			}
+			index[addr] = append(index[addr], forwardName{
+				name:   dns.CanonicalName(fqdn(name, z.Name)),
+				zoneId: z.Name,
+				record: record,
+			})
+		}
+	}
+	return index
+}
+
+// reverseAddress parses address from a in-addr.arpa or ip6.arpa name.
+func reverseAddress(qname string) (netip.Addr, bool) {
+	qname = dns.CanonicalName(qname)
+	if labels, ok := strings.CutSuffix(qname, ".in-addr.arpa."); ok {
+		parts := strings.Split(labels, ".")
+		if len(parts) != 4 {
+			return netip.Addr{}, false
+		}
+		var addr [4]byte
+		for i, part := range parts {
+			value, err := strconv.ParseUint(part, 10, 8)
+			if err != nil {
+				return netip.Addr{}, false
+			}
+			addr[3-i] = byte(value)
+		}
+		return netip.AddrFrom4(addr), true
+	}
+	if labels, ok := strings.CutSuffix(qname, ".ip6.arpa."); ok {
+		parts := strings.Split(labels, ".")
+		if len(parts) != 32 {
+			return netip.Addr{}, false
+		}
+		var addr [16]byte
+		for i, part := range parts {
+			value, err := strconv.ParseUint(part, 16, 4)
+			if err != nil || len(part) != 1 {
+				return netip.Addr{}, false
+			}
+			nibble := 31 - i
+			addr[nibble/2] |= byte(value) << (4 * (1 - nibble%2))
+		}
+		return netip.AddrFrom16(addr), true
+	}
+	return netip.Addr{}, false
+}
+
+func isPtr(record zone.DnsRecord) bool {
+	return record.Record.Header().Rrtype == dns.TypePTR
+}
+
+// reverseNames returns the current reverse index, building it if zones have
+// changed since it was last used.
+func (s *Server) reverseNames() reverseIndex {
+	s.reverseMutex.Lock()
+	defer s.reverseMutex.Unlock()
+	if s.reverse == nil {
+		s.reverse = buildReverseIndex(s.zones.LoadedZones())
+	}
+	return s.reverse
+}
+
+// synthesizePtr creates PTR records for names of forward records that point
+// to the address in qname.
+func (s *Server) synthesizePtr(config *zone.AutoReverse, qname string, view string) []zone.DnsRecord {
+	addr, ok := reverseAddress(qname)
+	if !ok {
+		return nil
+	}
+
+	// Find visible names and lowest TTL of each
+	ttls := make(map[string]uint32)
+	var names []string
+	for _, forward := range s.reverseNames()[addr] {
+		if len(config.Zones) != 0 && !slices.Contains(config.Zones, forward.zoneId) {
+			continue
+		}
+		if !visibleIn(forward.record, view) {
+			continue
+		}
+		ttl := forward.record.Record.Header().Ttl
+		if old, ok := ttls[forward.name]; !ok {
+			names = append(names, forward.name)
+			ttls[forward.name] = ttl
+		} else if ttl < old {
+			ttls[forward.name] = ttl
+		}
+	}
+	slices.Sort(names)
+
+	if len(names) > 1 {
+		switch config.Ambiguous {
+		case zone.AmbiguousAll:
+		case zone.AmbiguousNone:
+			return nil
+		default: // zone.AmbiguousFirst
+			names = names[:1]
+		}
+	}
+
+	records := make([]zone.DnsRecord, 0, len(names))
+	for _, name := range names {
+		ttl := ttls[name]
+		if config.Ttl != 0 {
+			ttl = config.Ttl
+		}
+		records = append(records, zone.DnsRecord{Record: &dns.PTR{
+			Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+			Ptr: name,
+		}})
+	}
+	return records
+}
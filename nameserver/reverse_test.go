@@ -0,0 +1,26 @@
+package nameserver
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestReverseAddress(t *testing.T) {
+	cases := map[string]string{
+		"10.2.0.192.in-addr.arpa.": "192.0.2.10",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.B.D.0.1.0.0.2.IP6.ARPA.": "2001:db8::1",
+		"2.0.192.in-addr.arpa.":   "",
+		"a.2.0.192.in-addr.arpa.": "",
+		"www.dove.test.":          "",
+	}
+	for name, expected := range cases {
+		addr, ok := reverseAddress(name)
+		if expected == "" {
+			if ok {
+				t.Errorf("%s should not be an address, got %s", name, addr)
+			}
+		} else if !ok || addr != netip.MustParseAddr(expected) {
+			t.Errorf("%s should be %s, got %s", name, expected, addr)
+		}
+	}
+}
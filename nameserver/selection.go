@@ -0,0 +1,77 @@
+package nameserver
+
+import (
+	"math"
+	"math/rand/v2"
+	"sort"
+
+	"github.com/bensku/dove/zone"
+)
+
+// groupRRsets splits records to RRsets by type, keeping the types in the
+// order they first appear in.
+func groupRRsets(records []zone.DnsRecord) [][]zone.DnsRecord {
+	var rrsets [][]zone.DnsRecord
+	index := make(map[uint16]int)
+	for _, record := range records {
+		rrtype := record.Record.Header().Rrtype
+		i, ok := index[rrtype]
+		if !ok {
+			i = len(rrsets)
+			index[rrtype] = i
+			rrsets = append(rrsets, nil)
+		}
+		rrsets[i] = append(rrsets[i], record)
+	}
+	return rrsets
+}
+
+// shuffleRRsets randomizes order of records within each RRset, with records
+// that have higher weight more likely to come first. RRsets that have an
+// answer limit set are cut to that length, which makes records with higher
+// weight be returned more often.
+func shuffleRRsets(records []zone.DnsRecord) []zone.DnsRecord {
+	if len(records) <= 1 {
+		return records
+	}
+
+	selected := make([]zone.DnsRecord, 0, len(records))
+	for _, rrset := range groupRRsets(records) {
+		rrset = weightedShuffle(rrset)
+		limit := len(rrset)
+		for _, record := range rrset {
+			if record.MaxAnswers > 0 && record.MaxAnswers < limit {
+				limit = record.MaxAnswers
+			}
+		}
+		selected = append(selected, rrset[:limit]...)
+	}
+	return selected
+}
+
+// weightedShuffle orders records randomly so that the probability of each
+// record being first is proportional to its weight. This is the
+// Efraimidis-Spirakis algorithm: every record gets a random key u^(1/w),
+// and records are sorted by it.
+func weightedShuffle(records []zone.DnsRecord) []zone.DnsRecord {
+	keys := make([]float64, len(records))
+	shuffled := make([]int, len(records))
+	for i, record := range records {
+		weight := float64(record.Weight)
+		if weight == 0 {
+			weight = 1
+		}
+		// Compare logarithms, ln(u)/w, to avoid precision issues with small u
+		keys[i] = math.Log(1-rand.Float64()) / weight
+		shuffled[i] = i
+	}
+	sort.Slice(shuffled, func(a, b int) bool {
+		return keys[shuffled[a]] > keys[shuffled[b]]
+	})
+
+	result := make([]zone.DnsRecord, len(records))
+	for i, index := range shuffled {
+		result[i] = records[index]
+	}
+	return result
+}
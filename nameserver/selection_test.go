@@ -0,0 +1,67 @@
+package nameserver
+
+import (
+	"testing"
+
+	"github.com/bensku/dove/zone"
+	"github.com/miekg/dns"
+)
+
+func testRecord(id string, rr string, weight uint16, maxAnswers int) zone.DnsRecord {
+	record, err := dns.NewRR(rr)
+	if err != nil {
+		panic(err)
+	}
+	return zone.DnsRecord{Id: id, Record: record, Weight: weight, MaxAnswers: maxAnswers}
+}
+
+func TestShuffleAll(t *testing.T) {
+	records := []zone.DnsRecord{
+		testRecord("a", "www 300 IN A 192.0.2.1", 0, 0),
+		testRecord("b", "www 300 IN A 192.0.2.2", 0, 0),
+		testRecord("c", "www 300 IN AAAA 2001:db8::1", 0, 0),
+		testRecord("d", "www 300 IN A 192.0.2.3", 0, 0),
+	}
+
+	firsts := make(map[string]int)
+	for range 3000 {
+		selected := shuffleRRsets(records)
+		if len(selected) != len(records) {
+			t.Fatal("without limit, all records should be returned", selected)
+		}
+		// RRsets are kept together, in their original order
+		if selected[3].Id != "c" {
+			t.Fatal("AAAA RRset should come after A", selected)
+		}
+		firsts[selected[0].Id]++
+	}
+	for _, id := range []string{"a", "b", "d"} {
+		if firsts[id] < 800 || firsts[id] > 1200 {
+			t.Errorf("record %s was first %d times out of 3000, expected about 1000", id, firsts[id])
+		}
+	}
+}
+
+func TestWeightedLimit(t *testing.T) {
+	records := []zone.DnsRecord{
+		testRecord("light", "www 300 IN A 192.0.2.1", 1, 1),
+		testRecord("heavy", "www 300 IN A 192.0.2.2", 3, 0),
+		testRecord("v6", "www 300 IN AAAA 2001:db8::1", 0, 0),
+	}
+
+	counts := make(map[string]int)
+	for range 4000 {
+		selected := shuffleRRsets(records)
+		if len(selected) != 2 {
+			t.Fatal("A RRset should be limited to one record", selected)
+		}
+		counts[selected[0].Id]++
+	}
+	// Expect 1:3 split between light and heavy
+	if counts["light"] < 800 || counts["light"] > 1200 {
+		t.Errorf("light record returned %d times out of 4000, expected about 1000", counts["light"])
+	}
+	if counts["heavy"] < 2800 || counts["heavy"] > 3200 {
+		t.Errorf("heavy record returned %d times out of 4000, expected about 3000", counts["heavy"])
+	}
+}
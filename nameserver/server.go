@@ -3,22 +3,256 @@ package nameserver
 import (
 	"context"
 	"log/slog"
+	"net/netip"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bensku/dove/zone"
 	"github.com/miekg/dns"
 )
 
+// Largest UDP payload size we advertise to EDNS clients
+const maxUdpSize = 1232
+
+type Options struct {
+	// Responses from zones that have not been refreshed from primary storage
+	// within this duration carry a "Stale Answer" Extended DNS Error.
+	// Zero disables staleness tracking.
+	StaleThreshold time.Duration
+
+	Dnstap   DnstapOptions
+	QueryLog *QueryLog
+
+	// Source of record health check results, nil to disable health checks
+	Health RecordHealth
+
+	// Client location lookup for location-tagged records, nil to disable
+	Geo GeoLocator
+
+	// Ignore EDNS Client Subnet options of all queries
+	IgnoreEcs bool
+	// Resolvers whose EDNS Client Subnet options are used; empty to use
+	// them from everyone
+	EcsTrustedNetworks []netip.Prefix
+
+	// Server identity, revealed by CHAOS class queries and NSID option
+	Chaos ChaosOptions
+
+	// Secrets for DNS cookies (RFC 7873), nil to disable cookies
+	Cookies CookieSecrets
+	// Refuse UDP queries with invalid server cookies with BADCOOKIE, instead
+	// of answering them like queries with only client cookie
+	EnforceCookies bool
+
+	// How ANY queries are answered: AnyHinfo (default), AnyRRset or AnyTcp
+	AnyPolicy string
+	// TSIG keys of clients that are allowed to see full zone contents,
+	// e.g. with ANY queries
+	TransferKeys []string
+
+	// Split-horizon views, checked in order
+	Views []View
+	// TSIG key names and their base64-encoded secrets
+	TsigSecrets map[string]string
+}
+
 type Server struct {
-	zones zone.ZoneServer
-	dns   *dns.Server
+	zones *zone.ZoneServer
+	mux   *dns.ServeMux
+	// UDP and TCP servers
+	dns []*dns.Server
+
+	dnstap   *dnstapLogger
+	queryLog *QueryLog
+	health   RecordHealth
+	geo      GeoLocator
+	views    []View
+	ecs      ecsPolicy
+	chaos    ChaosOptions
+	cookies  CookieSecrets
+
+	anyPolicy      string
+	transferKeys   []string
+	enforceCookies bool
+
+	// Addresses of A/AAAA records for auto reverse zones, nil when zones
+	// have changed and it needs to be rebuilt
+	reverseMutex sync.Mutex
+	reverse      reverseIndex
+}
+
+// Zones returns the zone server that provides data for this nameserver.
+func (s *Server) Zones() *zone.ZoneServer {
+	return s.zones
+}
+
+// matchRecords finds records that answer a query for given name (relative
+// to zone) and type. Exact matches are preferred over wildcards. Only records
+// visible in given view are considered.
+func matchRecords(records []zone.DnsRecord, name string, qtype uint16, view string) []zone.DnsRecord {
+	// IMPORTANT! Order of records we get from storage may be random!
+	var matches []zone.DnsRecord
+	for _, record := range records {
+		if !visibleIn(record, view) {
+			continue
+		}
+		slog.Debug("matching record", "name", record.Record.Header().Name, "type", dns.TypeToString[record.Record.Header().Rrtype])
+		recordName := record.Record.Header().Name
+
+		// Direct match
+		if recordName == name {
+			if qtype == dns.TypeANY || record.Record.Header().Rrtype == qtype {
+				matches = append(matches, record)
+			}
+		}
+	}
+	if len(matches) != 0 {
+		return matches // Skip wildcard matching
+	}
+
+	// If no results, try wildcard matching
+	wildcardName := ""
+	for _, record := range records {
+		if !visibleIn(record, view) {
+			continue
+		}
+		recordName := record.Record.Header().Name
+		if wildcardName != "" && recordName != wildcardName {
+			continue // Do not allow many wildcards!
+		}
+		if recordName[0] == '*' {
+			var wildcardSuffix string
+			if recordName[1] == '.' {
+				wildcardSuffix = recordName[2:]
+			} else {
+				wildcardSuffix = recordName[1:]
+			}
+
+			if strings.HasSuffix(name, wildcardSuffix) {
+				if qtype == dns.TypeANY || record.Record.Header().Rrtype == qtype {
+					wildcardName = recordName
+					matches = append(matches, record)
+				}
+			}
+		}
+	}
+	return matches
+}
+
+// selectRecords picks which of the matching records are included in answer.
+func (s *Server) selectRecords(zoneId string, records []zone.DnsRecord, client *clientInfo) []zone.DnsRecord {
+	records = filterByView(records, client.view)
+	if s.health != nil {
+		records = filterHealthy(zoneId, records, s.health)
+	}
+	if s.geo != nil && slices.ContainsFunc(records, hasGeoTags) {
+		location, located := s.geo.Locate(client.addr)
+		records = filterByLocation(records, location, located)
+		if located {
+			client.dependsOnAddress(location.PrefixLength)
+		} else {
+			// Answer is same for everyone in networks we know nothing about,
+			// but we don't know how large those networks are
+			client.dependsOnAddress(int(client.sourcePrefix))
+		}
+	}
+	return shuffleRRsets(records)
+}
+
+// Wait blocks until the nameserver has finished shutting down after its
+// context was cancelled. This includes flushing dnstap output.
+func (s *Server) Wait() {
+	if s.dnstap != nil {
+		<-s.dnstap.done
+	}
+}
+
+func (s *Server) onZoneUpdated(name string, zone *zone.Zone) {
+	s.reverseMutex.Lock()
+	s.reverse = nil
+	s.reverseMutex.Unlock()
+
+	if zone == nil {
+		// Previously existing zone was removed, clear handler
+		s.mux.HandleRemove(name)
+	} else {
+		// New zone was loaded or existing zone was updated (=replaced)
+		s.mux.HandleRemove(name) // Remove old handler (no-op if it doesn't exist)
+		s.mux.HandleFunc(name, func(w dns.ResponseWriter, m *dns.Msg) {
+			s.serveZone(zone, w, m)
+		})
+	}
+}
+
+// addEdnsOption adds an EDNS option to response, if the client supports EDNS.
+func addEdnsOption(m *dns.Msg, option dns.EDNS0) {
+	opt := m.IsEdns0()
+	if opt != nil {
+		opt.Option = append(opt.Option, option)
+	}
+}
+
+func (s *Server) serveZone(zone *zone.Zone, w dns.ResponseWriter, r *dns.Msg) {
+	start := time.Now()
+	m := s.handleRequest(zone, w, r)
+	err := w.WriteMsg(m)
+	if err != nil {
+		slog.Debug("failed to write DNS response", "error", err)
+	}
+	latency := time.Since(start)
+	observeQuery(zone.Name, w, r, m, latency)
+	if s.dnstap != nil {
+		s.dnstap.log(zone.Name, w, r, m, start)
+	}
+	if s.queryLog != nil {
+		s.queryLog.log(zone.Name, w, r, m, latency)
+	}
 }
 
-func handleRequest(zone *zone.Zone, w dns.ResponseWriter, r *dns.Msg) {
+func (s *Server) handleRequest(zone *zone.Zone, w dns.ResponseWriter, r *dns.Msg) *dns.Msg {
 	m := new(dns.Msg)
 	m.SetReply(r)
 	m.Authoritative = true
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(maxUdpSize, opt.Do())
+	}
+	s.addNsid(r, m)
+
+	if s.zones.IsStale(zone.Name) {
+		// Primary storage has not been reachable for a while (or ever)
+		addEdnsOption(m, &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeStaleAnswer,
+			ExtraText: "zone data could not be refreshed from primary storage",
+		})
+	}
+
+	client, err := newClientInfo(w, r, s.ecs)
+	if err != nil {
+		slog.Debug("malformed EDNS Client Subnet option", "error", err)
+		m.Rcode = dns.RcodeFormatError
+		return m
+	}
+	if s.cookies != nil {
+		var ok bool
+		client.cookie, ok = s.checkCookie(w, r, m, client)
+		if !ok {
+			return m
+		}
+	}
+	tsig := r.IsTsig()
+	if tsig != nil {
+		if w.TsigStatus() != nil {
+			// Unknown key or invalid signature
+			m.Rcode = dns.RcodeNotAuth
+			return m
+		}
+		client.tsigKey = tsig.Hdr.Name
+	}
+	if len(s.views) != 0 {
+		client.view = selectView(s.views, client.remote, client.tsigKey)
+	}
 
 	for _, q := range r.Question {
 		name := strings.TrimSuffix(q.Name, zone.Name)
@@ -26,88 +260,96 @@ func handleRequest(zone *zone.Zone, w dns.ResponseWriter, r *dns.Msg) {
 			name = "."
 		}
 		slog.Debug("incoming query", "query", name, "type", dns.TypeToString[q.Qtype])
-		// IMPORTANT! Order of records we get from storage may be random!
-		exactResults := false
-		for _, record := range zone.Records {
-			slog.Debug("matching record", "name", record.Record.Header().Name, "type", dns.TypeToString[record.Record.Header().Rrtype])
-			recordName := record.Record.Header().Name
-
-			// Direct match
-			if recordName == name {
-				if q.Qtype == dns.TypeANY || record.Record.Header().Rrtype == q.Qtype {
-					// Create a new record with the queried name
-					newRecord := dns.Copy(record.Record)
-					newRecord.Header().Name = q.Name
-					m.Answer = append(m.Answer, newRecord)
-					exactResults = true
-					continue
-				}
-			}
+
+		records := matchRecords(zone.Records, name, q.Qtype, client.view)
+		addr, rule := synthesizedAddress(zone.Config.Synthesize, name)
+		if rule != nil && !hasName(zone.Records, name, client.view) {
+			// Synthesized names take precedence over wildcards, but not
+			// over records that actually exist
+			records = synthesizeAddress(addr, rule, q.Qtype)
 		}
-		if exactResults {
-			continue // Skip wildcard matching
+		if zone.Config.AutoReverse != nil && (q.Qtype == dns.TypePTR || q.Qtype == dns.TypeANY) &&
+			!slices.ContainsFunc(records, isPtr) {
+			// Explicit PTR records win over synthesized ones
+			records = append(records, s.synthesizePtr(zone.Config.AutoReverse, q.Name, client.view)...)
 		}
-
-		// If no results, try wildcard matching
-		for _, record := range zone.Records {
-			recordName := record.Record.Header().Name
-			if recordName[0] == '*' {
-				var wildcardSuffix string
-				if recordName[1] == '.' {
-					wildcardSuffix = recordName[2:]
-				} else {
-					wildcardSuffix = recordName[1:]
-				}
-
-				if strings.HasSuffix(name, wildcardSuffix) {
-					if q.Qtype == dns.TypeANY || record.Record.Header().Rrtype == q.Qtype {
-						// Create a new record with the queried name
-						newRecord := dns.Copy(record.Record)
-						newRecord.Header().Name = q.Name
-						m.Answer = append(m.Answer, newRecord)
-						break // Do not allow many wildcards!
-					}
-				}
-			}
+		records = s.selectRecords(zone.Name, records, client)
+		if q.Qtype == dns.TypeANY {
+			records = s.minimizeAny(w, m, records, client)
+		}
+		if zone.Config.Dns64 != nil && q.Qtype == dns.TypeAAAA {
+			records = s.applyDns64(zone.Config.Dns64, zone.Name, zone.Records, name, records, client)
+		}
+		for _, record := range records {
+			// Create a new record with the queried name
+			newRecord := dns.Copy(record.Record)
+			newRecord.Header().Name = q.Name
+			m.Answer = append(m.Answer, newRecord)
 		}
 	}
+	client.addSubnetOption(m)
+	if tsig != nil {
+		// Sign response with the same key; TSIG must be last record
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+	}
 
-	w.WriteMsg(m)
+	return m
 }
 
-func New(ctx context.Context, listenAddr string, primary zone.ZoneStorage, fallback zone.ZoneStorage, refreshInterval time.Duration) *Server {
+func New(ctx context.Context, listenAddr string, primary zone.ZoneStorage, fallback zone.ZoneStorage,
+	refreshInterval time.Duration, opts Options) *Server {
 	handler := dns.NewServeMux()
+	server := Server{
+		mux:      handler,
+		queryLog: opts.QueryLog,
+		health:   opts.Health,
+		geo:      opts.Geo,
+		views:    opts.Views,
+		ecs:      ecsPolicy{ignore: opts.IgnoreEcs, trusted: opts.EcsTrustedNetworks},
+		chaos:    opts.Chaos,
+		cookies:  opts.Cookies,
 
-	onZoneUpdated := func(name string, zone *zone.Zone) {
-		if zone == nil {
-			// Previously existing zone was removed, clear handler
-			handler.HandleRemove(name)
+		anyPolicy:      opts.AnyPolicy,
+		enforceCookies: opts.EnforceCookies,
+	}
+	for _, key := range opts.TransferKeys {
+		server.transferKeys = append(server.transferKeys, dns.CanonicalName(key))
+	}
+	for _, network := range []string{"udp", "tcp"} {
+		server.dns = append(server.dns, &dns.Server{
+			Addr:       listenAddr,
+			Net:        network,
+			Handler:    dns.HandlerFunc(server.route),
+			TsigSecret: opts.TsigSecrets,
+		})
+	}
+	if opts.Dnstap.Enabled() {
+		dnstap, err := newDnstapLogger(ctx, opts.Dnstap)
+		if err != nil {
+			slog.Error("dnstap logging disabled", "error", err)
 		} else {
-			// New zone was loaded or existing zone was updated (=replaced)
-			handler.HandleRemove(name) // Remove old handler (no-op if it doesn't exist)
-			handler.HandleFunc(name, func(w dns.ResponseWriter, m *dns.Msg) {
-				handleRequest(zone, w, m)
-			})
+			server.dnstap = dnstap
 		}
 	}
+	server.zones = zone.NewZoneServer(ctx, primary, fallback, server.onZoneUpdated,
+		refreshInterval, opts.StaleThreshold)
 
-	server := Server{
-		zones: *zone.NewZoneServer(ctx, primary, fallback, onZoneUpdated, refreshInterval),
-		dns:   &dns.Server{Addr: listenAddr, Net: "udp", Handler: handler},
-	}
-
-	// Shutdown the DNS server when context is done
+	// Shutdown the DNS servers when context is done
 	go func() {
 		<-ctx.Done()
-		server.dns.Shutdown()
-	}()
-
-	go func() {
-		err := server.dns.ListenAndServe()
-		if err != nil {
-			slog.Error("DNS server failed to start", "error", err)
+		for _, dnsServer := range server.dns {
+			dnsServer.Shutdown()
 		}
 	}()
 
+	for _, dnsServer := range server.dns {
+		go func() {
+			err := dnsServer.ListenAndServe()
+			if err != nil {
+				slog.Error("DNS server failed to start", "network", dnsServer.Net, "error", err)
+			}
+		}()
+	}
+
 	return &server
 }
@@ -0,0 +1,52 @@
+package nameserver
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/bensku/dove/zone"
+	"github.com/miekg/dns"
+)
+
+func TestWildcardRecords(t *testing.T) {
+	server := &Server{zones: &zone.ZoneServer{}}
+	testZone := &zone.Zone{Name: "dove.test.", Records: []zone.DnsRecord{
+		testRecord("www", "www 300 IN A 192.0.2.1", 0, 0),
+		testRecord("wildcard1", "*.apps 300 IN A 192.0.2.2", 0, 0),
+		testRecord("wildcard2", "*.apps 300 IN A 192.0.2.3", 0, 0),
+		testRecord("wildcardTxt", "*.apps 300 IN TXT hello", 0, 0),
+	}}
+
+	cases := []struct {
+		name     string
+		expected []string
+	}{
+		// All records of wildcard RRset are answered, so that they can fail
+		// over to each other and be weighted like other RRsets
+		{"foo.apps", []string{"192.0.2.2", "192.0.2.3"}},
+		{"bar.foo.apps", []string{"192.0.2.2", "192.0.2.3"}},
+		// Exact matches win over wildcards
+		{"www", []string{"192.0.2.1"}},
+		{"mail", nil},
+	}
+	for _, c := range cases {
+		w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.100"), Port: 12345}}
+		r := new(dns.Msg)
+		r.SetQuestion(c.name+".dove.test.", dns.TypeA)
+		m := server.handleRequest(testZone, w, r)
+
+		var answers []string
+		for _, rr := range m.Answer {
+			a := rr.(*dns.A)
+			if a.Hdr.Name != c.name+".dove.test." {
+				t.Errorf("%s: wildcard answer has name %s", c.name, a.Hdr.Name)
+			}
+			answers = append(answers, a.A.String())
+		}
+		slices.Sort(answers)
+		if !slices.Equal(answers, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, answers)
+		}
+	}
+}
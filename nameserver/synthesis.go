@@ -0,0 +1,115 @@
+package nameserver
+
+import (
+	"encoding/hex"
+	"net/netip"
+	"strings"
+
+	"github.com/bensku/dove/zone"
+	"github.com/miekg/dns"
+)
+
+// Default TTL of synthesized address records
+const synthesisTtl = 60
+
+// synthesizedAddress finds the first rule whose subtree contains name
+// (relative to zone, with trailing dot) and decodes the address from it.
+func synthesizedAddress(rules []zone.SynthesisRule, name string) (netip.Addr, *zone.SynthesisRule) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for i := range rules {
+		rule := &rules[i]
+		encoded := name
+		if rule.Subtree != "" {
+			var ok bool
+			encoded, ok = strings.CutSuffix(name, "."+strings.ToLower(strings.Trim(rule.Subtree, ".")))
+			if !ok {
+				continue
+			}
+		}
+		addr, ok := decodeAddress(encoded, rule.Encoding)
+		if !ok {
+			continue
+		}
+		for _, network := range rule.AllowedNetworks {
+			if network.Contains(addr) {
+				return addr, rule
+			}
+		}
+	}
+	return netip.Addr{}, nil
+}
+
+// decodeAddress parses address from labels (without trailing dot) that
+// precede the subtree of a synthesis rule.
+func decodeAddress(labels string, encoding string) (netip.Addr, bool) {
+	if labels == "" {
+		return netip.Addr{}, false
+	}
+	switch encoding {
+	case zone.EncodingDotted:
+		parts := strings.Split(labels, ".")
+		if len(parts) < 4 {
+			return netip.Addr{}, false
+		}
+		addr, err := netip.ParseAddr(strings.Join(parts[len(parts)-4:], "."))
+		return addr, err == nil && addr.Is4()
+	case zone.EncodingHex:
+		if strings.Contains(labels, ".") {
+			return netip.Addr{}, false
+		}
+		digits := labels[strings.LastIndexByte(labels, '-')+1:]
+		data, err := hex.DecodeString(digits)
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		addr, ok := netip.AddrFromSlice(data)
+		return addr, ok
+	default: // zone.EncodingDashed
+		if strings.Contains(labels, ".") {
+			return netip.Addr{}, false
+		}
+		// IPv6 addresses take the whole label
+		addr, err := netip.ParseAddr(strings.ReplaceAll(labels, "-", ":"))
+		if err == nil && addr.Is6() && addr.Zone() == "" {
+			return addr, true
+		}
+		parts := strings.Split(labels, "-")
+		if len(parts) < 4 {
+			return netip.Addr{}, false
+		}
+		addr, err = netip.ParseAddr(strings.Join(parts[len(parts)-4:], "."))
+		return addr, err == nil && addr.Is4()
+	}
+}
+
+// hasName checks if any records visible in view exist with exactly the
+// given name.
+func hasName(records []zone.DnsRecord, name string, view string) bool {
+	for _, record := range records {
+		if visibleIn(record, view) && strings.EqualFold(record.Record.Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// synthesizeAddress creates an A or AAAA record answering query of given
+// type, or nil if the rule's address is not of that type.
+func synthesizeAddress(addr netip.Addr, rule *zone.SynthesisRule, qtype uint16) []zone.DnsRecord {
+	ttl := rule.Ttl
+	if ttl == 0 {
+		ttl = synthesisTtl
+	}
+	hdr := dns.RR_Header{Class: dns.ClassINET, Ttl: ttl}
+	var rr dns.RR
+	if addr.Is4() && (qtype == dns.TypeA || qtype == dns.TypeANY) {
+		hdr.Rrtype = dns.TypeA
+		rr = &dns.A{Hdr: hdr, A: addr.AsSlice()}
+	} else if addr.Is6() && (qtype == dns.TypeAAAA || qtype == dns.TypeANY) {
+		hdr.Rrtype = dns.TypeAAAA
+		rr = &dns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()}
+	} else {
+		return nil
+	}
+	return []zone.DnsRecord{{Record: rr}}
+}
@@ -0,0 +1,43 @@
+package nameserver
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/bensku/dove/zone"
+)
+
+func TestSynthesizedAddress(t *testing.T) {
+	allowed := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")}
+	rules := []zone.SynthesisRule{
+		{Subtree: "dev", AllowedNetworks: allowed},
+		{Subtree: "dotted.dev", Encoding: zone.EncodingDotted, AllowedNetworks: allowed},
+		{Subtree: "hex", Encoding: zone.EncodingHex, AllowedNetworks: allowed},
+	}
+	cases := map[string]string{
+		"10-0-0-5.dev.":                         "10.0.0.5",
+		"App-10-0-0-5.Dev.":                     "10.0.0.5",
+		"fd00--1.dev.":                          "fd00::1",
+		"app.10.0.0.5.dotted.dev.":              "10.0.0.5",
+		"app-0a000005.hex.":                     "10.0.0.5",
+		"fd000000000000000000000000000001.hex.": "fd00::1",
+		// Outside allowed networks
+		"192-0-2-1.dev.":   "",
+		"2001-db8--1.dev.": "",
+		// Not addresses, or outside subtrees
+		"www.dev.":        "",
+		"10-0-0.dev.":     "",
+		"10-0-0-5.":       "",
+		"x.10-0-0-5.dev.": "",
+	}
+	for name, expected := range cases {
+		addr, rule := synthesizedAddress(rules, name)
+		if expected == "" {
+			if rule != nil {
+				t.Errorf("%s should not be synthesized, got %s", name, addr)
+			}
+		} else if rule == nil || addr != netip.MustParseAddr(expected) {
+			t.Errorf("%s should be %s, got %s", name, expected, addr)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package nameserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+
+	"github.com/bensku/dove/zone"
+	"github.com/miekg/dns"
+)
+
+// View is a named group of clients that may see different records than
+// others, e.g. private addresses for internal clients.
+type View struct {
+	Name string `json:"name"`
+	// Client source networks that belong to this view
+	Networks []netip.Prefix `json:"networks"`
+	// Names of TSIG keys; clients that sign queries with them belong to
+	// this view regardless of their address
+	TsigKeys []string `json:"tsigKeys"`
+}
+
+// LoadViews reads view definitions from a JSON file. Every TSIG key used
+// by views must have a secret in given map.
+func LoadViews(path string, tsigSecrets map[string]string) ([]View, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read views: %v", err)
+	}
+	var views []View
+	err = json.Unmarshal(data, &views)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse views: %v", err)
+	}
+	for i, view := range views {
+		if view.Name == "" {
+			return nil, fmt.Errorf("view %d has no name", i)
+		}
+		for j, key := range view.TsigKeys {
+			key = dns.CanonicalName(key)
+			if _, ok := tsigSecrets[key]; !ok {
+				return nil, fmt.Errorf("view %s uses unknown TSIG key %s", view.Name, key)
+			}
+			views[i].TsigKeys[j] = key
+		}
+	}
+	return views, nil
+}
+
+// LoadTsigSecrets reads TSIG key names and their base64-encoded secrets
+// from a JSON file.
+func LoadTsigSecrets(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TSIG keys: %v", err)
+	}
+	var keys map[string]string
+	err = json.Unmarshal(data, &keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse TSIG keys: %v", err)
+	}
+	secrets := make(map[string]string, len(keys))
+	for name, secret := range keys {
+		secrets[dns.CanonicalName(name)] = secret
+	}
+	return secrets, nil
+}
+
+// selectView finds the first view that client belongs to. Queries signed
+// with a view's TSIG key (tsigKey is empty if query was not signed)
+// belong to it, other queries are matched by source address. Empty name is
+// returned if client is not in any view.
+func selectView(views []View, addr netip.Addr, tsigKey string) string {
+	if tsigKey != "" {
+		for _, view := range views {
+			if slices.Contains(view.TsigKeys, tsigKey) {
+				return view.Name
+			}
+		}
+	}
+	addr = addr.Unmap()
+	for _, view := range views {
+		for _, network := range view.Networks {
+			if network.Contains(addr) {
+				return view.Name
+			}
+		}
+	}
+	return ""
+}
+
+// visibleIn checks if record can be seen by clients in given view.
+func visibleIn(record zone.DnsRecord, view string) bool {
+	return record.View == "" || record.View == view
+}
+
+// filterByView removes shared records from RRsets that have records
+// specific to client's view; view-specific records replace them.
+func filterByView(records []zone.DnsRecord, view string) []zone.DnsRecord {
+	if view == "" {
+		return records // Only shared records are visible
+	}
+	overridden := make(map[uint16]bool)
+	for _, record := range records {
+		if record.View == view {
+			overridden[record.Record.Header().Rrtype] = true
+		}
+	}
+	if len(overridden) == 0 {
+		return records
+	}
+
+	selected := make([]zone.DnsRecord, 0, len(records))
+	for _, record := range records {
+		if record.View == view || !overridden[record.Record.Header().Rrtype] {
+			selected = append(selected, record)
+		}
+	}
+	return selected
+}
@@ -0,0 +1,75 @@
+package nameserver
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/bensku/dove/zone"
+	"github.com/miekg/dns"
+)
+
+func viewRecord(id string, rr string, view string) zone.DnsRecord {
+	record := testRecord(id, rr, 0, 0)
+	record.View = view
+	return record
+}
+
+func TestViews(t *testing.T) {
+	server := &Server{
+		zones: &zone.ZoneServer{},
+		views: []View{
+			{Name: "internal", Networks: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}},
+			{Name: "partner", TsigKeys: []string{"partner-key."}},
+		},
+	}
+	testZone := &zone.Zone{Name: "dove.test.", Records: []zone.DnsRecord{
+		viewRecord("public", "www 300 IN A 192.0.2.1", ""),
+		viewRecord("private", "www 300 IN A 10.0.0.1", "internal"),
+		viewRecord("partner", "www 300 IN A 172.16.0.1", "partner"),
+		viewRecord("mail", "mail 300 IN A 192.0.2.2", ""),
+		viewRecord("intranet", "intranet 300 IN A 10.0.0.2", "internal"),
+	}}
+
+	cases := []struct {
+		client   string
+		tsigKey  string
+		tsigErr  error
+		name     string
+		expected string
+		rcode    int
+	}{
+		{"192.0.2.100", "", nil, "www", "192.0.2.1", dns.RcodeSuccess},
+		{"10.1.2.3", "", nil, "www", "10.0.0.1", dns.RcodeSuccess},
+		{"::ffff:10.1.2.3", "", nil, "www", "10.0.0.1", dns.RcodeSuccess},
+		{"192.0.2.100", "partner-key.", nil, "www", "172.16.0.1", dns.RcodeSuccess},
+		// Shared records are seen by all views
+		{"10.1.2.3", "", nil, "mail", "192.0.2.2", dns.RcodeSuccess},
+		// Records of other views are not
+		{"192.0.2.100", "", nil, "intranet", "", dns.RcodeSuccess},
+		{"192.0.2.100", "partner-key.", dns.ErrSig, "www", "", dns.RcodeNotAuth},
+	}
+	for _, c := range cases {
+		w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP(c.client), Port: 12345}, tsigErr: c.tsigErr}
+		r := new(dns.Msg)
+		r.SetQuestion(c.name+".dove.test.", dns.TypeA)
+		if c.tsigKey != "" {
+			r.SetTsig(c.tsigKey, dns.HmacSHA256, 300, 0)
+		}
+
+		m := server.handleRequest(testZone, w, r)
+		if m.Rcode != c.rcode {
+			t.Errorf("%s from %s: expected rcode %d, got %d", c.name, c.client, c.rcode, m.Rcode)
+		}
+		var answers []string
+		for _, rr := range m.Answer {
+			answers = append(answers, rr.(*dns.A).A.String())
+		}
+		if c.expected == "" && len(answers) != 0 || c.expected != "" && (len(answers) != 1 || answers[0] != c.expected) {
+			t.Errorf("%s from %s: expected %q, got %v", c.name, c.client, c.expected, answers)
+		}
+		if c.tsigKey != "" && c.tsigErr == nil && m.IsTsig() == nil {
+			t.Errorf("%s from %s: response to signed query should be signed", c.name, c.client)
+		}
+	}
+}
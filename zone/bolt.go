@@ -0,0 +1,411 @@
+package zone
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bucket layout: zones/<zone id>/records/<record id> contains packed records,
+// and zones/<zone id> has zone metadata under meta key.
+var (
+	boltZones   = []byte("zones")
+	boltRecords = []byte("records")
+	boltMeta    = []byte("meta")
+)
+
+// Metadata of a zone in bolt storage.
+type boltZoneMeta struct {
+	// Whether zone is served (AddZone has been called)
+	Listed bool `json:"listed"`
+	// Changed on every update; copied from the source when zone is replaced
+	Version string `json:"version"`
+	// When zone was last replaced by a copy from primary storage, zero if
+	// it has been changed locally after that
+	SyncedAt time.Time  `json:"syncedAt"`
+	Config   ZoneConfig `json:"config"`
+}
+
+// BoltStorage stores zones in a bbolt database file. Every change is done
+// in a transaction, so it works both as primary storage of a single node
+// and as fallback storage.
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+func NewBoltStorage(path string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open zone database: %v", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltZones)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize zone database: %v", err)
+	}
+	return &BoltStorage{db: db}, nil
+}
+
+func readMeta(bucket *bolt.Bucket) (boltZoneMeta, error) {
+	var meta boltZoneMeta
+	data := bucket.Get(boltMeta)
+	if data == nil {
+		return meta, nil
+	}
+	err := json.Unmarshal(data, &meta)
+	if err != nil {
+		return meta, fmt.Errorf("failed to parse zone metadata: %v", err)
+	}
+	return meta, nil
+}
+
+func writeMeta(bucket *bolt.Bucket, meta boltZoneMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to serialize zone metadata: %v", err)
+	}
+	return bucket.Put(boltMeta, data)
+}
+
+// update runs a function with zone metadata and records bucket in one
+// transaction, creating the zone if needed.
+func (storage *BoltStorage) update(zoneId string, update func(meta *boltZoneMeta, records *bolt.Bucket) error) error {
+	return storage.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(boltZones).CreateBucketIfNotExists([]byte(zoneId))
+		if err != nil {
+			return fmt.Errorf("failed to create zone: %v", err)
+		}
+		records, err := bucket.CreateBucketIfNotExists(boltRecords)
+		if err != nil {
+			return fmt.Errorf("failed to create zone: %v", err)
+		}
+		meta, err := readMeta(bucket)
+		if err != nil {
+			return err
+		}
+		err = update(&meta, records)
+		if err != nil {
+			return err
+		}
+		return writeMeta(bucket, meta)
+	})
+}
+
+// modify is like update, but also marks the zone as changed locally after
+// the function has been run.
+func (storage *BoltStorage) modify(zoneId string, modify func(meta *boltZoneMeta, records *bolt.Bucket) error) error {
+	return storage.update(zoneId, func(meta *boltZoneMeta, records *bolt.Bucket) error {
+		err := modify(meta, records)
+		if err != nil {
+			return err
+		}
+		meta.Version = uuid.New().String()
+		meta.SyncedAt = time.Time{}
+		return nil
+	})
+}
+
+func (storage *BoltStorage) ListZones(ctx context.Context) ([]string, error) {
+	zones := make([]string, 0)
+	err := storage.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltZones).ForEachBucket(func(name []byte) error {
+			meta, err := readMeta(tx.Bucket(boltZones).Bucket(name))
+			if err != nil {
+				return err
+			}
+			if meta.Listed {
+				zones = append(zones, string(name))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list zones: %v", err)
+	}
+	return zones, nil
+}
+
+func (storage *BoltStorage) AddZone(ctx context.Context, zoneId string) error {
+	return storage.update(zoneId, func(meta *boltZoneMeta, records *bolt.Bucket) error {
+		meta.Listed = true
+		return nil
+	})
+}
+
+func (storage *BoltStorage) DeleteZone(ctx context.Context, zoneId string) error {
+	err := storage.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltZones).Bucket([]byte(zoneId))
+		if bucket == nil {
+			return nil
+		}
+		meta, err := readMeta(bucket)
+		if err != nil {
+			return err
+		}
+		meta.Listed = false
+		return writeMeta(bucket, meta)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete zone: %v", err)
+	}
+	return nil
+}
+
+func (storage *BoltStorage) Load(ctx context.Context, zoneId string) (Zone, error) {
+	zone := Zone{Name: zoneId, Records: make([]DnsRecord, 0)}
+	err := storage.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltZones).Bucket([]byte(zoneId))
+		if bucket == nil {
+			return nil // Empty zone
+		}
+		meta, err := readMeta(bucket)
+		if err != nil {
+			return err
+		}
+		zone.UpdatedHash = meta.Version
+		zone.SyncedAt = meta.SyncedAt
+		zone.Config = meta.Config
+
+		records := bucket.Bucket(boltRecords)
+		if records == nil {
+			return nil
+		}
+		return records.ForEach(func(id, data []byte) error {
+			record, _, err := unpackRecord(data, 0)
+			if err != nil {
+				return fmt.Errorf("failed to unpack record: %v", err)
+			}
+			record.Id = string(id)
+			zone.Records = append(zone.Records, record)
+			return nil
+		})
+	})
+	if err != nil {
+		return Zone{}, fmt.Errorf("failed to load zone: %v", err)
+	}
+	return zone, nil
+}
+
+func (storage *BoltStorage) IsCurrent(ctx context.Context, zone *Zone) (bool, error) {
+	if zone == nil {
+		return false, nil // Not loaded at all yet
+	}
+	var version string
+	err := storage.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltZones).Bucket([]byte(zone.Name))
+		if bucket == nil {
+			return nil
+		}
+		meta, err := readMeta(bucket)
+		version = meta.Version
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to lookup zone version: %v", err)
+	}
+	// Zone that has never had records matches only an empty zone
+	return version == zone.UpdatedHash, nil
+}
+
+func (storage *BoltStorage) Patch(ctx context.Context, zoneId string, record DnsRecord) error {
+	slog.Debug("patching record", "zone", zoneId, "id", record.Id, "record", record.Record)
+	data, err := packRecord(record)
+	if err != nil {
+		return err
+	}
+	err = storage.modify(zoneId, func(meta *boltZoneMeta, records *bolt.Bucket) error {
+		return records.Put([]byte(record.Id), data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to patch record: %v", err)
+	}
+	return nil
+}
+
+func (storage *BoltStorage) Delete(ctx context.Context, zoneId string, id string) error {
+	slog.Debug("deleting record", "zone", zoneId, "id", id)
+	err := storage.modify(zoneId, func(meta *boltZoneMeta, records *bolt.Bucket) error {
+		return records.Delete([]byte(id))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete record: %v", err)
+	}
+	return nil
+}
+
+func (storage *BoltStorage) SetConfig(ctx context.Context, zoneId string, config ZoneConfig) error {
+	slog.Debug("setting zone config", "zone", zoneId, "config", config)
+	err := storage.modify(zoneId, func(meta *boltZoneMeta, records *bolt.Bucket) error {
+		meta.Config = config
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set zone config: %v", err)
+	}
+	return nil
+}
+
+// Replace sets content of zone, keeping version of the zone it was copied
+// from. Replaced zones are listed, as this is how zones are copied to
+// fallback storage.
+func (storage *BoltStorage) Replace(ctx context.Context, zone Zone) error {
+	return storage.replace(zone, time.Now())
+}
+
+func (storage *BoltStorage) replace(zone Zone, syncedAt time.Time) error {
+	slog.Debug("replacing zone", "zone", zone.Name, "records", len(zone.Records))
+	packed := make([][]byte, len(zone.Records))
+	for i, record := range zone.Records {
+		data, err := packRecord(record)
+		if err != nil {
+			return err
+		}
+		packed[i] = data
+	}
+
+	err := storage.update(zone.Name, func(meta *boltZoneMeta, records *bolt.Bucket) error {
+		meta.Listed = true
+		meta.Version = zone.UpdatedHash
+		if meta.Version == "" {
+			meta.Version = uuid.New().String()
+		}
+		meta.SyncedAt = syncedAt
+		meta.Config = zone.Config
+
+		err := clearBucket(records)
+		if err != nil {
+			return err
+		}
+		for i, record := range zone.Records {
+			err = records.Put([]byte(record.Id), packed[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to replace zone: %v", err)
+	}
+	return nil
+}
+
+func (storage *BoltStorage) Apply(ctx context.Context, zoneId string, changes Changeset) error {
+	slog.Debug("applying changeset", "zone", zoneId, "put", len(changes.Put), "delete", len(changes.Delete))
+	packed := make([][]byte, len(changes.Put))
+	for i, record := range changes.Put {
+		data, err := packRecord(record)
+		if err != nil {
+			return err
+		}
+		packed[i] = data
+	}
+	err := storage.modify(zoneId, func(meta *boltZoneMeta, records *bolt.Bucket) error {
+		if changes.Version != "" && changes.Version != meta.Version {
+			return ErrVersionMismatch
+		}
+		if changes.Clear {
+			meta.Config = ZoneConfig{}
+			err := clearBucket(records)
+			if err != nil {
+				return err
+			}
+		}
+		if changes.Config != nil {
+			meta.Config = *changes.Config
+		}
+		for _, id := range changes.Delete {
+			err := records.Delete([]byte(id))
+			if err != nil {
+				return err
+			}
+		}
+		for i, record := range changes.Put {
+			err := records.Put([]byte(record.Id), packed[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to apply changeset: %w", err)
+	}
+	return nil
+}
+
+func (storage *BoltStorage) Clear(ctx context.Context, zoneId string) error {
+	slog.Debug("clearing zone", "zone", zoneId)
+	err := storage.modify(zoneId, func(meta *boltZoneMeta, records *bolt.Bucket) error {
+		meta.Config = ZoneConfig{}
+		return clearBucket(records)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to clear zone: %v", err)
+	}
+	return nil
+}
+
+func clearBucket(bucket *bolt.Bucket) error {
+	cursor := bucket.Cursor()
+	for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+		err := cursor.Delete()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (storage *BoltStorage) Close() error {
+	return storage.db.Close()
+}
+
+// MigrateFallbackDir copies zones from a fallback directory of FileStorage,
+// keeping their versions. The directory is renamed afterwards, so that it
+// is not migrated again. Missing directory is not an error, and unreadable
+// zone files are skipped; they are reloaded from primary storage anyway.
+func (storage *BoltStorage) MigrateFallbackDir(ctx context.Context, path string) error {
+	_, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil // Nothing to migrate
+	}
+	from, err := NewFileStorage(path)
+	if err != nil {
+		return err
+	}
+	zoneIds, err := from.ListZones(ctx)
+	if err != nil {
+		return err
+	}
+	for _, zoneId := range zoneIds {
+		zone, err := from.Load(ctx, zoneId)
+		if err != nil {
+			slog.Error("skipped unreadable fallback zone", "zoneId", zoneId, "error", err)
+			continue
+		}
+		err = storage.replace(zone, zone.SyncedAt)
+		if err != nil {
+			return fmt.Errorf("failed to migrate zone %s: %v", zoneId, err)
+		}
+		slog.Info("migrated fallback zone", "zoneId", zoneId, "records", len(zone.Records))
+	}
+	err = os.Rename(path, path+".migrated")
+	if err != nil {
+		return fmt.Errorf("failed to rename migrated fallback directory: %v", err)
+	}
+	return nil
+}
+
+var _ ZoneStorage = (*BoltStorage)(nil)
@@ -0,0 +1,119 @@
+package zone_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bensku/dove/zone"
+	"github.com/miekg/dns"
+)
+
+func boltStorage(t *testing.T) *zone.BoltStorage {
+	storage, err := zone.NewBoltStorage(filepath.Join(t.TempDir(), "dove.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { storage.Close() })
+	return storage
+}
+
+func TestBoltStorage(t *testing.T) {
+	testStorage(t, boltStorage(t))
+}
+
+func TestBoltZoneList(t *testing.T) {
+	testZoneList(t, boltStorage(t))
+}
+
+func TestBoltReplace(t *testing.T) {
+	testReplace(t, boltStorage(t))
+}
+
+func TestBoltApply(t *testing.T) {
+	testApply(t, boltStorage(t))
+}
+
+func TestBoltVersion(t *testing.T) {
+	testVersion(t, boltStorage(t))
+}
+
+func TestBoltFallback(t *testing.T) {
+	storage := boltStorage(t)
+	ctx := context.Background()
+
+	// Copies from primary keep their version
+	rr, _ := dns.NewRR("www A 127.0.0.1")
+	longId := strings.Repeat("x", 1000)
+	primaryZone := zone.Zone{Name: "test.", Records: []zone.DnsRecord{{Id: longId, Record: rr}}, UpdatedHash: "42"}
+	current, _ := storage.IsCurrent(ctx, &primaryZone)
+	if current {
+		t.Fatal("missing zone should not be current")
+	}
+	err := zone.InternalTransfer(ctx, primaryZone, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, _ = storage.IsCurrent(ctx, &primaryZone)
+	if !current {
+		t.Fatal("transferred zone should be current")
+	}
+	zoneIds, _ := storage.ListZones(ctx)
+	if len(zoneIds) != 1 || zoneIds[0] != "test." {
+		t.Fatal("transferred zone should be listed", zoneIds)
+	}
+	testZone, err := storage.Load(ctx, "test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(testZone.Records) != 1 || testZone.Records[0].Id != longId || testZone.UpdatedHash != "42" || testZone.SyncedAt.IsZero() {
+		t.Fatal("unexpected zone", testZone)
+	}
+
+	// Local changes make it differ from every primary version
+	storage.Delete(ctx, "test.", longId)
+	current, _ = storage.IsCurrent(ctx, &primaryZone)
+	if current {
+		t.Fatal("modified zone should not be current")
+	}
+	testZone, _ = storage.Load(ctx, "test.")
+	if !testZone.SyncedAt.IsZero() {
+		t.Fatal("modified zone should not have sync time")
+	}
+}
+
+func TestBoltMigration(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "zones")
+	files, err := zone.NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	rr, _ := dns.NewRR("www A 127.0.0.1")
+	files.Replace(ctx, zone.Zone{Name: "test.", Records: []zone.DnsRecord{{Id: "www", Record: rr}}, UpdatedHash: "42"})
+	os.WriteFile(filepath.Join(dir, "broken."), []byte("DOVE\x02garbage"), 0644) // Skipped
+
+	storage := boltStorage(t)
+	err = storage.MigrateFallbackDir(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testZone, err := storage.Load(ctx, "test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(testZone.Records) != 1 || testZone.UpdatedHash != "42" {
+		t.Fatal("zone was not migrated", testZone)
+	}
+	if _, err := os.Stat(dir); err == nil {
+		t.Fatal("migrated directory should have been renamed")
+	}
+
+	// Nothing left to migrate
+	err = storage.MigrateFallbackDir(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
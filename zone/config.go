@@ -0,0 +1,134 @@
+package zone
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// Record id under which zone configuration is stored. Record ids starting
+// with "__" are reserved for internal use.
+const configId = "__config"
+
+// ZoneConfig holds settings that change how a zone is served.
+type ZoneConfig struct {
+	// If set, this is a reverse zone (in-addr.arpa or ip6.arpa) that answers
+	// PTR queries based on A/AAAA records of other zones
+	AutoReverse *AutoReverse `json:"autoReverse,omitempty"`
+
+	// Rules for answering A/AAAA queries of names that encode an address,
+	// e.g. 10-0-0-5.dev.example.com. First matching rule is used.
+	Synthesize []SynthesisRule `json:"synthesize,omitempty"`
+
+	// If set, AAAA records are synthesized from A records for IPv6-only
+	// clients behind NAT64
+	Dns64 *Dns64 `json:"dns64,omitempty"`
+
+	// Set on zones that are synced from a zone directory; the sync only
+	// overwrites and removes zones that have this set
+	Synced bool `json:"synced,omitempty"`
+}
+
+const (
+	// Return PTR records for all names that point to the address
+	AmbiguousAll = "all"
+	// Return PTR record for the alphabetically first name only
+	AmbiguousFirst = "first"
+	// Do not synthesize anything if more than one name points to the address
+	AmbiguousNone = "none"
+)
+
+// AutoReverse configures synthesized PTR answers. Explicit PTR records of
+// the zone always take precedence over them.
+type AutoReverse struct {
+	// Forward zones whose A/AAAA records are used, empty for all zones
+	Zones []string `json:"zones,omitempty"`
+	// What to do when many names point to one address: "first" (default),
+	// "all" or "none"
+	Ambiguous string `json:"ambiguous,omitempty"`
+	// TTL of synthesized records, defaults to TTL of the forward record
+	Ttl uint32 `json:"ttl,omitempty"`
+}
+
+const (
+	// Address in one label, separated by dashes: 10-0-0-5 or 2001-db8--1.
+	// For IPv4, anything before the address is ignored: app-10-0-0-5.
+	EncodingDashed = "dashed"
+	// IPv4 address as four labels, with optional labels before: 10.0.0.5
+	EncodingDotted = "dotted"
+	// Address as 8 or 32 hex digits in one label, with optional prefix
+	// separated by dash: 0a000005 or app-0a000005
+	EncodingHex = "hex"
+)
+
+// SynthesisRule generates A/AAAA answers for names that encode addresses.
+// Records that exist with the name always take precedence.
+type SynthesisRule struct {
+	// Name (relative to zone) under which addresses are encoded, empty for
+	// zone apex. For example, "dev" for 10-0-0-5.dev.example.com.
+	Subtree string `json:"subtree,omitempty"`
+	// How addresses are encoded to names: "dashed" (default), "dotted" or "hex"
+	Encoding string `json:"encoding,omitempty"`
+	// TTL of synthesized records, defaults to 60 seconds
+	Ttl uint32 `json:"ttl,omitempty"`
+	// Only addresses in these networks are answered; must not be empty
+	AllowedNetworks []netip.Prefix `json:"allowedNetworks"`
+}
+
+// Dns64 configures AAAA synthesis (RFC 6147) for names that have A records
+// but no AAAA records.
+type Dns64 struct {
+	// NAT64 prefix, defaults to 64:ff9b::/96
+	Prefix netip.Prefix `json:"prefix,omitempty"`
+	// Clients that get synthesized records; must not be empty
+	ClientNetworks []netip.Prefix `json:"clientNetworks"`
+	// IPv4 networks that are never mapped to IPv6, and IPv6 networks whose
+	// AAAA records are ignored (treated as if they did not exist)
+	Exclude []netip.Prefix `json:"exclude,omitempty"`
+}
+
+// Well-known NAT64 prefix (RFC 6052)
+var WellKnownNat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// Nat64Prefix returns the configured prefix, or the well-known one.
+func (config *Dns64) Nat64Prefix() netip.Prefix {
+	if !config.Prefix.IsValid() {
+		return WellKnownNat64Prefix
+	}
+	return config.Prefix
+}
+
+// Validate checks that the configuration makes sense.
+func (config *ZoneConfig) Validate() error {
+	if config.AutoReverse != nil {
+		switch config.AutoReverse.Ambiguous {
+		case "", AmbiguousAll, AmbiguousFirst, AmbiguousNone:
+		default:
+			return fmt.Errorf("unknown ambiguous mapping policy %s", config.AutoReverse.Ambiguous)
+		}
+	}
+	for _, rule := range config.Synthesize {
+		switch rule.Encoding {
+		case "", EncodingDashed, EncodingDotted, EncodingHex:
+		default:
+			return fmt.Errorf("unknown address encoding %s", rule.Encoding)
+		}
+		if len(rule.AllowedNetworks) == 0 {
+			return fmt.Errorf("synthesis rule for %q needs allowed networks", rule.Subtree)
+		}
+	}
+	if config.Dns64 != nil {
+		prefix := config.Dns64.Nat64Prefix()
+		switch prefix.Bits() {
+		case 32, 40, 48, 56, 64, 96:
+		default:
+			return fmt.Errorf("NAT64 prefix length must be 32, 40, 48, 56, 64 or 96")
+		}
+		if !prefix.Addr().Is6() || prefix.Masked() != prefix {
+			return fmt.Errorf("NAT64 prefix must be an IPv6 network address")
+		}
+		if len(config.Dns64.ClientNetworks) == 0 {
+			return fmt.Errorf("DNS64 needs client networks")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,439 @@
+package zone
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/miekg/dns"
+)
+
+// Extension of zone files in zone directory
+const zoneFileExtension = ".zone"
+
+// ErrReadOnly is returned when changing zones of read-only storage.
+var ErrReadOnly = errors.New("zone storage is read-only")
+
+// Zone file in a zone directory
+type directoryZone struct {
+	// Hash of file content when it was last read, valid or not
+	hash string
+	// Last valid version of the zone, nil if there has not been any
+	zone *Zone
+}
+
+// DirectoryStorage serves zones from a directory of RFC 1035 zone files
+// named <zone>.zone, e.g. kept in git. The directory is rescanned whenever
+// zones are listed, and watched for changes. Broken files are rejected and
+// the last valid version of them is kept. Zones cannot be changed through
+// the storage.
+type DirectoryStorage struct {
+	Path string
+
+	mutex sync.RWMutex
+	zones map[string]*directoryZone
+}
+
+func NewDirectoryStorage(path string) (*DirectoryStorage, error) {
+	storage := &DirectoryStorage{
+		Path:  path,
+		zones: make(map[string]*directoryZone),
+	}
+	err := storage.scan()
+	if err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+// zoneOfFile returns zone that a file in zone directory contains, or empty
+// string if it is not a zone file.
+func zoneOfFile(fileName string) string {
+	name := filepath.Base(fileName)
+	if !strings.HasSuffix(name, zoneFileExtension) || strings.HasPrefix(name, ".") {
+		return "" // Not a zone, or hidden file (e.g. editor swap file)
+	}
+	return strings.TrimSuffix(name, zoneFileExtension) + "."
+}
+
+// scan reads zone files that have changed since previous scan.
+func (storage *DirectoryStorage) scan() error {
+	files, err := os.ReadDir(storage.Path)
+	if err != nil {
+		return fmt.Errorf("failed to list zone directory: %v", err)
+	}
+	found := make(map[string]bool)
+	for _, file := range files {
+		id := zoneOfFile(file.Name())
+		if file.IsDir() || id == "" {
+			continue
+		}
+		found[id] = true
+		storage.read(id, filepath.Join(storage.Path, file.Name()))
+	}
+
+	storage.mutex.Lock()
+	for id := range storage.zones {
+		if !found[id] {
+			delete(storage.zones, id)
+			slog.Info("zone file removed", "zone", id)
+		}
+	}
+	storage.mutex.Unlock()
+	return nil
+}
+
+// read parses a zone file if its content has changed, keeping the previous
+// version of the zone if the file is not valid.
+func (storage *DirectoryStorage) read(id string, path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		slog.Error("failed to read zone file", "path", path, "error", err)
+		return
+	}
+	if len(data) == 0 {
+		// Probably being written, as files are truncated before writing
+		return
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:16])
+
+	storage.mutex.RLock()
+	previous := storage.zones[id]
+	storage.mutex.RUnlock()
+	if previous != nil && previous.hash == hash {
+		return // Unchanged
+	}
+
+	entry := &directoryZone{hash: hash}
+	if previous != nil {
+		entry.zone = previous.zone
+	}
+	records, err := ParseZoneFile(bytes.NewReader(data), id)
+	if err != nil {
+		slog.Error("rejected broken zone file, serving last valid version", "path", path, "error", err)
+	} else {
+		entry.zone = &Zone{Name: id, Records: records, UpdatedHash: hash}
+		slog.Info("read zone file", "zone", id, "records", len(records))
+	}
+	storage.mutex.Lock()
+	storage.zones[id] = entry
+	storage.mutex.Unlock()
+}
+
+// ListZones rescans the directory and lists zones that have valid files.
+func (storage *DirectoryStorage) ListZones(ctx context.Context) ([]string, error) {
+	err := storage.scan()
+	if err != nil {
+		return nil, err
+	}
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	zones := make([]string, 0, len(storage.zones))
+	for id, entry := range storage.zones {
+		if entry.zone != nil {
+			zones = append(zones, id)
+		}
+	}
+	slices.Sort(zones)
+	return zones, nil
+}
+
+// BrokenZones lists zones whose files exist but have never been valid.
+// Zones that are broken now but had a valid version are listed normally.
+func (storage *DirectoryStorage) BrokenZones(ctx context.Context) ([]string, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	zones := make([]string, 0)
+	for id, entry := range storage.zones {
+		if entry.zone == nil {
+			zones = append(zones, id)
+		}
+	}
+	slices.Sort(zones)
+	return zones, nil
+}
+
+func (storage *DirectoryStorage) Load(ctx context.Context, zoneId string) (Zone, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	entry, ok := storage.zones[zoneId]
+	if !ok || entry.zone == nil {
+		return Zone{Name: zoneId, Records: make([]DnsRecord, 0)}, nil
+	}
+	zone := *entry.zone
+	zone.Records = make([]DnsRecord, len(entry.zone.Records))
+	for i, record := range entry.zone.Records {
+		record.Record = dns.Copy(record.Record) // Callers may modify records
+		zone.Records[i] = record
+	}
+	return zone, nil
+}
+
+func (storage *DirectoryStorage) IsCurrent(ctx context.Context, zone *Zone) (bool, error) {
+	if zone == nil {
+		return false, nil // Not loaded at all yet
+	}
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	entry, ok := storage.zones[zone.Name]
+	if !ok || entry.zone == nil {
+		return zone.UpdatedHash == "", nil
+	}
+	return entry.zone.UpdatedHash == zone.UpdatedHash, nil
+}
+
+func (storage *DirectoryStorage) AddZone(ctx context.Context, zoneId string) error {
+	return ErrReadOnly
+}
+
+func (storage *DirectoryStorage) DeleteZone(ctx context.Context, zoneId string) error {
+	return ErrReadOnly
+}
+
+func (storage *DirectoryStorage) Patch(ctx context.Context, zoneId string, record DnsRecord) error {
+	return ErrReadOnly
+}
+
+func (storage *DirectoryStorage) Delete(ctx context.Context, zoneId string, id string) error {
+	return ErrReadOnly
+}
+
+func (storage *DirectoryStorage) Clear(ctx context.Context, zoneId string) error {
+	return ErrReadOnly
+}
+
+func (storage *DirectoryStorage) SetConfig(ctx context.Context, zoneId string, config ZoneConfig) error {
+	return ErrReadOnly
+}
+
+func (storage *DirectoryStorage) Replace(ctx context.Context, zone Zone) error {
+	return ErrReadOnly
+}
+
+func (storage *DirectoryStorage) Apply(ctx context.Context, zoneId string, changes Changeset) error {
+	return ErrReadOnly
+}
+
+// Changes watches the zone directory with inotify. Changed files are read
+// before their zones are announced. If the directory cannot be watched,
+// channel is nil and changes are only noticed when zones are listed.
+func (storage *DirectoryStorage) Changes(ctx context.Context) <-chan string {
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(storage.Path)
+	}
+	if err != nil {
+		slog.Error("failed to watch zone directory", "path", storage.Path, "error", err)
+		if watcher != nil {
+			watcher.Close()
+		}
+		return nil
+	}
+
+	changes := make(chan string, 16)
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event := <-watcher.Events:
+				id := zoneOfFile(event.Name)
+				if id == "" {
+					continue
+				}
+				if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+					storage.scan()
+				} else {
+					storage.read(id, event.Name)
+				}
+				select {
+				case changes <- id:
+				default: // Full, zones will be reloaded anyway
+				}
+			case err := <-watcher.Errors:
+				slog.Warn("zone directory watcher", "error", err)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return changes
+}
+
+// SyncedZones finds zones of storage that have been synced from a zone
+// directory, as marked in their config.
+func SyncedZones(ctx context.Context, storage ZoneStorage) (map[string]bool, error) {
+	zoneIds, err := storage.ListZones(ctx)
+	if err != nil {
+		return nil, err
+	}
+	synced := make(map[string]bool)
+	for _, id := range zoneIds {
+		zone, err := storage.Load(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if zone.Config.Synced {
+			synced[id] = true
+		}
+	}
+	return synced, nil
+}
+
+// SyncZones makes zones of target storage match the zones of source, e.g.
+// to publish zones kept in a directory through etcd. Synced zones are
+// marked in their config, and synced contains them (see SyncedZones).
+// Other zones of target are never touched, even if source has them too.
+// Synced zones that no longer exist in the source are removed, but zones
+// that source reports as broken are kept (see BrokenZoneLister).
+func SyncZones(ctx context.Context, from ZoneStorage, to ZoneStorage, synced map[string]bool) error {
+	zoneIds, err := from.ListZones(ctx)
+	if err != nil {
+		return err
+	}
+	targetIds, err := to.ListZones(ctx)
+	if err != nil {
+		return err
+	}
+	var brokenIds []string
+	if lister, ok := from.(BrokenZoneLister); ok {
+		brokenIds, err = lister.BrokenZones(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	for _, id := range zoneIds {
+		zone, err := from.Load(ctx, id)
+		if err != nil {
+			return err
+		}
+		target, err := to.Load(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !synced[id] {
+			if slices.Contains(targetIds, id) && !target.Config.Synced {
+				slog.Warn("zone exists and is not synced, ignoring its zone file", "zone", id)
+				continue
+			}
+			err = to.AddZone(ctx, id)
+			if err != nil {
+				return err
+			}
+			synced[id] = true
+		}
+		if sameRecords(zone, target) && target.Config.Synced {
+			continue
+		}
+		// Keep zone options that zone files cannot have
+		config := target.Config
+		config.Synced = true
+		err = to.Replace(ctx, Zone{Name: id, Records: zone.Records, Config: config})
+		if err != nil {
+			return err
+		}
+		slog.Info("synced zone", "zone", id, "records", len(zone.Records))
+	}
+
+	for id := range synced {
+		if slices.Contains(brokenIds, id) {
+			// Keep serving whatever target has until the file is fixed
+			slog.Warn("zone file is broken, keeping synced zone", "zone", id)
+			continue
+		}
+		if !slices.Contains(zoneIds, id) {
+			err = to.Clear(ctx, id)
+			if err == nil {
+				err = to.DeleteZone(ctx, id)
+			}
+			if err != nil {
+				return err
+			}
+			delete(synced, id)
+			slog.Info("removed synced zone", "zone", id)
+		}
+	}
+	return nil
+}
+
+// sameRecords checks if zones have exactly the same records, including
+// their options.
+func sameRecords(a Zone, b Zone) bool {
+	if len(a.Records) != len(b.Records) {
+		return false
+	}
+	packed := make(map[string][]byte, len(b.Records))
+	for _, record := range b.Records {
+		data, err := packRecord(record)
+		if err != nil {
+			return false
+		}
+		packed[record.Id] = data
+	}
+	for _, record := range a.Records {
+		data, err := packRecord(record)
+		if err != nil || !bytes.Equal(data, packed[record.Id]) {
+			return false
+		}
+	}
+	return true
+}
+
+// StartSync keeps zones of target storage in sync with source storage
+// until context is done. Zones are synced on every interval, and whenever
+// source announces changes.
+func StartSync(ctx context.Context, from ZoneStorage, to ZoneStorage, interval time.Duration) {
+	var synced map[string]bool
+	sync := func() {
+		syncCtx, cancelFunc := context.WithTimeout(ctx, 10*time.Second)
+		defer cancelFunc()
+		if synced == nil {
+			// Zones synced before restart are found from target storage
+			var err error
+			synced, err = SyncedZones(syncCtx, to)
+			if err != nil {
+				slog.Error("failed to find synced zones", "error", err)
+				return
+			}
+		}
+		err := SyncZones(syncCtx, from, to, synced)
+		if err != nil {
+			slog.Error("failed to sync zones", "error", err)
+		}
+	}
+	sync()
+
+	go func() {
+		var changes <-chan string
+		if notifier, ok := from.(ChangeNotifier); ok {
+			changes = notifier.Changes(ctx)
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sync()
+			case <-changes:
+				sync()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+var _ ZoneStorage = (*DirectoryStorage)(nil)
+var _ ChangeNotifier = (*DirectoryStorage)(nil)
+var _ BrokenZoneLister = (*DirectoryStorage)(nil)
@@ -0,0 +1,162 @@
+package zone_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bensku/dove/zone"
+	"github.com/miekg/dns"
+)
+
+const testZoneFile = `$ORIGIN dove.test.
+$TTL 300
+@ IN A 192.0.2.1
+www IN CNAME @
+`
+
+const otherZoneFile = `$ORIGIN other.test.
+$TTL 300
+@ IN A 192.0.2.3
+`
+
+func TestDirectoryStorage(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dove.test.zone")
+	os.WriteFile(path, []byte(testZoneFile), 0644)
+	os.WriteFile(filepath.Join(dir, "README.md"), []byte("not a zone"), 0644)
+	storage, err := zone.NewDirectoryStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	changes := storage.Changes(ctx)
+
+	zoneIds, _ := storage.ListZones(ctx)
+	if len(zoneIds) != 1 || zoneIds[0] != "dove.test." {
+		t.Fatal("unexpected zones", zoneIds)
+	}
+	testZone, err := storage.Load(ctx, "dove.test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(testZone.Records) != 2 || testZone.Records[1].Record.String() != "www.\t300\tIN\tCNAME\tdove.test." {
+		t.Fatal("unexpected records", testZone.Records)
+	}
+	if storage.Patch(ctx, "dove.test.", testZone.Records[0]) != zone.ErrReadOnly {
+		t.Fatal("zones should not be writable")
+	}
+
+	// Broken files are rejected
+	os.WriteFile(path, []byte(testZoneFile+"broken IN A not-an-address\n"), 0644)
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("change was not noticed")
+	}
+	current, _ := storage.IsCurrent(ctx, &testZone)
+	if !current {
+		t.Fatal("last valid version should be kept")
+	}
+
+	// Fixed files are loaded
+	os.WriteFile(path, []byte(testZoneFile+"fixed IN A 192.0.2.2\n"), 0644)
+	zoneIds, _ = storage.ListZones(ctx)
+	current, _ = storage.IsCurrent(ctx, &testZone)
+	if current {
+		t.Fatal("fixed file should be a new version")
+	}
+	testZone, _ = storage.Load(ctx, "dove.test.")
+	if len(zoneIds) != 1 || len(testZone.Records) != 3 {
+		t.Fatal("fixed file was not loaded", zoneIds, testZone.Records)
+	}
+}
+
+func TestSyncZones(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dove.test.zone")
+	os.WriteFile(path, []byte(testZoneFile), 0644)
+	source, err := zone.NewDirectoryStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := zone.NewMemoryStorage()
+	ctx := context.Background()
+	target.AddZone(ctx, "other.test.")
+	target.SetConfig(ctx, "dove.test.", zone.ZoneConfig{AutoReverse: &zone.AutoReverse{}})
+
+	synced := make(map[string]bool)
+	err = zone.SyncZones(ctx, source, target, synced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testZone, _ := target.Load(ctx, "dove.test.")
+	if len(testZone.Records) != 2 || testZone.Config.AutoReverse == nil || !testZone.Config.Synced {
+		t.Fatal("zone was not synced", testZone)
+	}
+
+	// Unchanged zones are not written again
+	err = zone.SyncZones(ctx, source, target, synced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, _ := target.IsCurrent(ctx, &testZone)
+	if !current {
+		t.Fatal("unchanged zone was replaced")
+	}
+
+	// Zones that exist but were not synced are not taken over
+	rr, _ := dns.NewRR("manual A 192.0.2.9")
+	target.Patch(ctx, "other.test.", zone.DnsRecord{Id: "manual", Record: rr})
+	os.WriteFile(filepath.Join(dir, "other.test.zone"), []byte(otherZoneFile), 0644)
+	zoneIds, _ := source.ListZones(ctx)
+	if len(zoneIds) != 2 {
+		t.Fatal("other zone file should be valid", zoneIds)
+	}
+	err = zone.SyncZones(ctx, source, target, synced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherZone, _ := target.Load(ctx, "other.test.")
+	if len(otherZone.Records) != 1 || otherZone.Records[0].Id != "manual" || otherZone.Config.Synced {
+		t.Fatal("existing zone was overwritten", otherZone)
+	}
+
+	// Broken files without a valid version, e.g. after restart, are not
+	// mistaken for removed files
+	os.WriteFile(path, []byte("broken IN BOGUS 1\n"), 0644)
+	restarted, err := zone.NewDirectoryStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	synced, _ = zone.SyncedZones(ctx, target)
+	err = zone.SyncZones(ctx, restarted, target, synced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testZone, _ = target.Load(ctx, "dove.test.")
+	if len(testZone.Records) != 2 || !synced["dove.test."] {
+		t.Fatal("synced zone with broken file was removed", testZone)
+	}
+
+	// Zones removed from source are removed, also after restart
+	os.Remove(path)
+	synced, err = zone.SyncedZones(ctx, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !synced["dove.test."] || synced["other.test."] {
+		t.Fatal("unexpected synced zones", synced)
+	}
+	err = zone.SyncZones(ctx, source, target, synced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zoneIds, _ = target.ListZones(ctx)
+	if len(zoneIds) != 1 || zoneIds[0] != "other.test." {
+		t.Fatal("unexpected zones after removal", zoneIds)
+	}
+}
@@ -3,11 +3,12 @@ package zone
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
+	"slices"
 
 	"github.com/google/uuid"
-	"github.com/miekg/dns"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
@@ -66,20 +67,29 @@ func (storage *EtcdStorage) Load(ctx context.Context, zoneId string) (Zone, erro
 	// Load entire zone from etcd as binary data
 	records := make([]DnsRecord, 0)
 	updatedKey := []byte(prefix + "__updatedHash")
+	configKey := []byte(prefix + configId)
 	updatedHash := ""
+	var config ZoneConfig
 	for _, kv := range resp.Kvs {
 		if bytes.Equal(kv.Key, updatedKey) {
 			updatedHash = string(kv.Value)
 			continue
 		}
+		if bytes.Equal(kv.Key, configKey) {
+			err = json.Unmarshal(kv.Value, &config)
+			if err != nil {
+				return Zone{}, fmt.Errorf("failed to parse zone config: %v", err)
+			}
+			continue
+		}
 
-		rr, _, err := dns.UnpackRR(kv.Value, 0)
+		record, _, err := unpackRecord(kv.Value, 0)
 		if err != nil {
 			return Zone{}, fmt.Errorf("failed to unpack record: %v", err)
 		}
 
-		id := kv.Key[len(prefix):]
-		records = append(records, DnsRecord{Id: string(id), Record: rr})
+		record.Id = string(kv.Key[len(prefix):])
+		records = append(records, record)
 	}
 	slog.Debug("loaded zone from etcd", "zone", zoneId, "records", records)
 
@@ -87,6 +97,7 @@ func (storage *EtcdStorage) Load(ctx context.Context, zoneId string) (Zone, erro
 		Name:        zoneId,
 		Records:     records,
 		UpdatedHash: updatedHash,
+		Config:      config,
 	}, nil
 }
 
@@ -110,16 +121,15 @@ func (storage *EtcdStorage) IsCurrent(ctx context.Context, zone *Zone) (bool, er
 
 func (storage *EtcdStorage) Patch(ctx context.Context, zoneId string, record DnsRecord) error {
 	slog.Debug("patching record", "zone", zoneId, "id", record.Id, "record", record.Record)
-	data := make([]byte, dns.Len(record.Record))
-	end, err := dns.PackRR(record.Record, data, 0, nil, false)
+	data, err := packRecord(record)
 	if err != nil {
-		return fmt.Errorf("failed to pack DNS record: %v", err)
+		return err
 	}
 
 	updatedHash := uuid.New().String()
 	prefix := storage.etcdPrefix(zoneId)
 	txn := storage.client.KV.Txn(ctx).Then(
-		clientv3.OpPut(prefix+record.Id, string(data[:end])),
+		clientv3.OpPut(prefix+record.Id, string(data)),
 		clientv3.OpPut(prefix+"__updatedHash", updatedHash),
 	)
 	_, err = txn.Commit()
@@ -146,6 +156,184 @@ func (storage *EtcdStorage) Delete(ctx context.Context, zoneId string, id string
 	return nil
 }
 
+func (storage *EtcdStorage) SetConfig(ctx context.Context, zoneId string, config ZoneConfig) error {
+	slog.Debug("setting zone config", "zone", zoneId, "config", config)
+	data, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to serialize zone config: %v", err)
+	}
+
+	updatedHash := uuid.New().String()
+	prefix := storage.etcdPrefix(zoneId)
+	txn := storage.client.KV.Txn(ctx).Then(
+		clientv3.OpPut(prefix+configId, string(data)),
+		clientv3.OpPut(prefix+"__updatedHash", updatedHash),
+	)
+	_, err = txn.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to set zone config: %v", err)
+	}
+	return nil
+}
+
+// Maximum operations in one etcd transaction (default of --max-txn-ops)
+const maxTxnOps = 128
+
+// Apply makes changes in one transaction, so changesets can have at most
+// maxTxnOps-1 changes, unless they can be staged. Config counts as a change.
+func (storage *EtcdStorage) Apply(ctx context.Context, zoneId string, changes Changeset) error {
+	slog.Debug("applying changeset", "zone", zoneId, "put", len(changes.Put), "delete", len(changes.Delete), "clear", changes.Clear)
+	changes = changes.normalized()
+	prefix := storage.etcdPrefix(zoneId)
+	hashKey := prefix + "__updatedHash"
+
+	// New records first, so that none are missing while old ones are
+	// deleted if changeset is staged
+	ops := make([]clientv3.Op, 0, len(changes.Put)+len(changes.Delete)+2)
+	keep := []string{hashKey}
+	for _, record := range changes.Put {
+		data, err := packRecord(record)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, clientv3.OpPut(prefix+record.Id, string(data)))
+		keep = append(keep, prefix+record.Id)
+	}
+	if changes.Config != nil {
+		data, err := json.Marshal(changes.Config)
+		if err != nil {
+			return fmt.Errorf("failed to serialize zone config: %v", err)
+		}
+		ops = append(ops, clientv3.OpPut(prefix+configId, string(data)))
+		keep = append(keep, prefix+configId)
+	}
+	for _, id := range changes.Delete {
+		ops = append(ops, clientv3.OpDelete(prefix+id))
+	}
+	if changes.Clear {
+		ops = append(ops, clearOps(prefix, keep)...)
+	}
+	ops = append(ops, clientv3.OpPut(hashKey, uuid.New().String()))
+
+	if len(ops) > maxTxnOps {
+		if changes.Staged {
+			return storage.applyStaged(ctx, hashKey, changes.Version, ops)
+		}
+		return fmt.Errorf("%w, at most %d changes are allowed", ErrChangesetTooLarge, maxTxnOps-1)
+	}
+	txn := storage.client.KV.Txn(ctx)
+	if changes.Version != "" {
+		// Zone must not have changed since the version changes are based on
+		txn = txn.If(clientv3.Compare(clientv3.Value(hashKey), "=", changes.Version))
+	}
+	resp, err := txn.Then(ops...).Commit()
+	if err != nil {
+		return fmt.Errorf("failed to apply changeset: %v", err)
+	}
+	if !resp.Succeeded {
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
+// clearOps returns operations that delete everything under prefix except
+// the given keys. Keys that are put cannot be deleted in same transaction,
+// so the ranges between them are deleted instead.
+func clearOps(prefix string, keep []string) []clientv3.Op {
+	keep = slices.Clone(keep)
+	slices.Sort(keep)
+	ops := make([]clientv3.Op, 0)
+	start := prefix
+	for _, key := range keep {
+		if start < key {
+			ops = append(ops, clientv3.OpDelete(start, clientv3.WithRange(key)))
+		}
+		start = key + "\x00" // Next possible key
+	}
+	return append(ops, clientv3.OpDelete(start, clientv3.WithRange(clientv3.GetPrefixRangeEnd(prefix))))
+}
+
+// applyStaged writes operations of a changeset in several transactions,
+// like Replace. If changeset has a version, every transaction checks that
+// nothing else has changed the zone since it was checked.
+func (storage *EtcdStorage) applyStaged(ctx context.Context, hashKey string, version string, ops []clientv3.Op) error {
+	resp, err := storage.client.KV.Get(ctx, hashKey)
+	if err != nil {
+		return fmt.Errorf("failed to lookup updatedHash: %v", err)
+	}
+	var revision int64 // Zero if zone has never had records
+	if len(resp.Kvs) != 0 {
+		if version != "" && string(resp.Kvs[0].Value) != version {
+			return ErrVersionMismatch
+		}
+		revision = resp.Kvs[0].ModRevision
+	} else if version != "" {
+		return ErrVersionMismatch
+	}
+
+	for start := 0; start < len(ops); start += maxTxnOps {
+		end := min(start+maxTxnOps, len(ops))
+		txn := storage.client.KV.Txn(ctx)
+		if version != "" {
+			// Every change bumps updatedHash, so its revision is enough
+			txn = txn.If(clientv3.Compare(clientv3.ModRevision(hashKey), "=", revision))
+		}
+		resp, err := txn.Then(ops[start:end]...).Commit()
+		if err != nil {
+			return fmt.Errorf("failed to apply changeset: %v", err)
+		}
+		if !resp.Succeeded {
+			if start == 0 {
+				return ErrVersionMismatch
+			}
+			return fmt.Errorf("%w, changeset was applied partially", ErrVersionMismatch)
+		}
+	}
+	return nil
+}
+
+func (storage *EtcdStorage) Replace(ctx context.Context, zone Zone) error {
+	slog.Debug("replacing zone", "zone", zone.Name, "records", len(zone.Records))
+	prefix := storage.etcdPrefix(zone.Name)
+	resp, err := storage.client.KV.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return fmt.Errorf("failed to lookup zone: %v", err)
+	}
+
+	// Large zones do not fit in one transaction. New records are written
+	// first and old ones deleted after that; zone is marked as updated last,
+	// so that nodes reload it once it is complete.
+	config, err := json.Marshal(zone.Config)
+	if err != nil {
+		return fmt.Errorf("failed to serialize zone config: %v", err)
+	}
+	ops := []clientv3.Op{clientv3.OpPut(prefix+configId, string(config))}
+	keep := map[string]bool{prefix + configId: true, prefix + "__updatedHash": true}
+	for _, record := range zone.Records {
+		data, err := packRecord(record)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, clientv3.OpPut(prefix+record.Id, string(data)))
+		keep[prefix+record.Id] = true
+	}
+	for _, kv := range resp.Kvs {
+		if !keep[string(kv.Key)] {
+			ops = append(ops, clientv3.OpDelete(string(kv.Key)))
+		}
+	}
+	ops = append(ops, clientv3.OpPut(prefix+"__updatedHash", uuid.New().String()))
+
+	for start := 0; start < len(ops); start += maxTxnOps {
+		end := min(start+maxTxnOps, len(ops))
+		_, err = storage.client.KV.Txn(ctx).Then(ops[start:end]...).Commit()
+		if err != nil {
+			return fmt.Errorf("failed to replace zone: %v", err)
+		}
+	}
+	return nil
+}
+
 func (storage *EtcdStorage) Clear(ctx context.Context, zoneId string) error {
 	slog.Debug("clearing zone", "zone", zoneId)
 	_, err := storage.client.KV.Delete(ctx, storage.prefix+zoneId, clientv3.WithPrefix())
@@ -2,23 +2,43 @@ package zone_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/bensku/dove/zone"
 	"github.com/miekg/dns"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
-func TestEtcdStorage(t *testing.T) {
+// etcdStorage connects to development etcd cluster, skipping the test if
+// it is not running.
+func etcdStorage(t *testing.T) *zone.EtcdStorage {
 	client, err := clientv3.New(clientv3.Config{
 		Endpoints: []string{"http://localhost:2379", "http://localhost:22379", "http://localhost:32379"},
 	})
 	if err != nil {
 		t.Fatal(err)
 	}
+	t.Cleanup(func() { client.Close() })
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelFunc()
+	_, err = client.Get(ctx, "health")
+	if err != nil {
+		t.Skip("etcd is not available:", err)
+	}
+	return zone.NewEtcdStorage(client, "testZones/")
+}
+
+func TestEtcdStorage(t *testing.T) {
+	testStorage(t, etcdStorage(t))
+}
 
+func testStorage(t *testing.T, storage zone.ZoneStorage) {
 	ctx := context.Background()
-	storage := zone.NewEtcdStorage(client, "testZones/")
 
 	// // Empty zone load
 	testZone, err := storage.Load(ctx, "test")
@@ -129,15 +149,11 @@ func TestEtcdStorage(t *testing.T) {
 }
 
 func TestEtcdZoneList(t *testing.T) {
-	client, err := clientv3.New(clientv3.Config{
-		Endpoints: []string{"http://localhost:2379", "http://localhost:22379", "http://localhost:32379"},
-	})
-	if err != nil {
-		t.Fatal(err)
-	}
+	testZoneList(t, etcdStorage(t))
+}
 
+func testZoneList(t *testing.T, storage zone.ZoneStorage) {
 	ctx := context.Background()
-	storage := zone.NewEtcdStorage(client, "testZones/")
 
 	zoneIds, err := storage.ListZones(ctx)
 	if err != nil {
@@ -176,3 +192,218 @@ func TestEtcdZoneList(t *testing.T) {
 		t.Fatal("zone was not deleted", zoneIds)
 	}
 }
+
+func TestEtcdReplace(t *testing.T) {
+	testReplace(t, etcdStorage(t))
+}
+
+func testReplace(t *testing.T, storage zone.ZoneStorage) {
+	ctx := context.Background()
+	rr, _ := dns.NewRR("old A 127.0.0.1")
+	storage.Patch(ctx, "test", zone.DnsRecord{Id: "old", Record: rr})
+
+	// More records than fit in one transaction
+	replacement := zone.Zone{Name: "test", Config: zone.ZoneConfig{AutoReverse: &zone.AutoReverse{}}}
+	for i := range 300 {
+		rr, _ := dns.NewRR(fmt.Sprintf("host%d A 127.0.%d.%d", i, i/256, i%256))
+		replacement.Records = append(replacement.Records, zone.DnsRecord{Id: fmt.Sprint("host", i), Record: rr})
+	}
+	err := storage.Replace(ctx, replacement)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testZone, err := storage.Load(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(testZone.Records) != 300 || slices.ContainsFunc(testZone.Records, func(record zone.DnsRecord) bool {
+		return record.Id == "old"
+	}) {
+		t.Fatal("zone should contain exactly the replacement records, has", len(testZone.Records))
+	}
+	if testZone.Config.AutoReverse == nil {
+		t.Fatal("zone config was not replaced")
+	}
+
+	storage.Clear(ctx, "test")
+}
+
+func TestEtcdApply(t *testing.T) {
+	storage := etcdStorage(t)
+	testApply(t, storage)
+
+	// Too large changesets must be rejected without changing anything
+	var changes zone.Changeset
+	for i := range 200 {
+		changes.Delete = append(changes.Delete, fmt.Sprint("host", i))
+	}
+	err := storage.Apply(context.Background(), "test", changes)
+	if !errors.Is(err, zone.ErrChangesetTooLarge) {
+		t.Fatal("expected changeset to be too large, got", err)
+	}
+
+	// Config counts as a change
+	changes = zone.Changeset{Config: &zone.ZoneConfig{}}
+	for i := range 127 {
+		rr, _ := dns.NewRR(fmt.Sprintf("host%d A 127.0.0.%d", i, i))
+		changes.Put = append(changes.Put, zone.DnsRecord{Id: fmt.Sprint("host", i), Record: rr})
+	}
+	err = storage.Apply(context.Background(), "test", changes)
+	if !errors.Is(err, zone.ErrChangesetTooLarge) {
+		t.Fatal("expected changeset with config to be too large, got", err)
+	}
+
+	// Zones of any size can be cleared at once
+	changes.Config = nil
+	changes.Staged = true
+	err = storage.Apply(context.Background(), "test", changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, _ := storage.Load(context.Background(), "test")
+	err = storage.Apply(context.Background(), "test", zone.Changeset{Clear: true, Version: full.UpdatedHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleared, _ := storage.Load(context.Background(), "test")
+	if len(cleared.Records) != 0 || cleared.UpdatedHash == full.UpdatedHash {
+		t.Fatal("zone was not cleared", len(cleared.Records))
+	}
+
+	// Unless they can be staged
+	ctx := context.Background()
+	rr, _ := dns.NewRR("old A 127.0.0.1")
+	storage.Patch(ctx, "test", zone.DnsRecord{Id: "old", Record: rr})
+	before, _ := storage.Load(ctx, "test")
+	changes = zone.Changeset{Delete: []string{"old"}, Version: before.UpdatedHash, Staged: true}
+	for i := range 200 {
+		rr, _ := dns.NewRR(fmt.Sprintf("host%d A 127.0.0.%d", i, i))
+		changes.Put = append(changes.Put, zone.DnsRecord{Id: fmt.Sprint("host", i), Record: rr})
+	}
+	err = storage.Apply(ctx, "test", changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testZone, _ := storage.Load(ctx, "test")
+	if len(testZone.Records) != 200 || testZone.UpdatedHash == before.UpdatedHash {
+		t.Fatal("staged changeset was not applied", len(testZone.Records))
+	}
+	err = storage.Apply(ctx, "test", changes)
+	if !errors.Is(err, zone.ErrVersionMismatch) {
+		t.Fatal("expected version mismatch, got", err)
+	}
+	storage.Clear(ctx, "test")
+}
+
+func testApply(t *testing.T, storage zone.ZoneStorage) {
+	ctx := context.Background()
+	rr, _ := dns.NewRR("old A 127.0.0.1")
+	storage.Patch(ctx, "test", zone.DnsRecord{Id: "old", Record: rr})
+	rr, _ = dns.NewRR("kept A 127.0.0.2")
+	storage.Patch(ctx, "test", zone.DnsRecord{Id: "kept", Record: rr})
+	before, err := storage.Load(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newRR, _ := dns.NewRR("new A 127.0.0.3")
+	replacedRR, _ := dns.NewRR("kept A 127.0.0.4")
+	err = storage.Apply(ctx, "test", zone.Changeset{
+		Put:    []zone.DnsRecord{{Id: "new", Record: newRR}, {Id: "kept", Record: replacedRR}},
+		Delete: []string{"old", "new"}, // Deletes are applied before puts
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testZone, err := storage.Load(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(testZone.Records) != 2 {
+		t.Fatal("expected 2 records, got", len(testZone.Records))
+	}
+	for _, record := range testZone.Records {
+		switch record.Id {
+		case "new":
+			if record.Record.String() != newRR.String() {
+				t.Fatal("unexpected record", record.Record)
+			}
+		case "kept":
+			if record.Record.String() != replacedRR.String() {
+				t.Fatal("record was not replaced", record.Record)
+			}
+		default:
+			t.Fatal("unexpected record", record.Id)
+		}
+	}
+	current, err := storage.IsCurrent(ctx, &before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current {
+		t.Fatal("zone version did not change")
+	}
+
+	// Clearing deletes everything else, config included
+	storage.SetConfig(ctx, "test", zone.ZoneConfig{AutoReverse: &zone.AutoReverse{}})
+	err = storage.Apply(ctx, "test", zone.Changeset{
+		Clear: true,
+		Put:   []zone.DnsRecord{{Id: "new", Record: newRR}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testZone, err = storage.Load(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(testZone.Records) != 1 || testZone.Records[0].Id != "new" || testZone.Config.AutoReverse != nil {
+		t.Fatal("zone was not cleared", testZone)
+	}
+
+	storage.Clear(ctx, "test")
+}
+
+func TestEtcdVersion(t *testing.T) {
+	testVersion(t, etcdStorage(t))
+}
+
+func testVersion(t *testing.T, storage zone.ZoneStorage) {
+	ctx := context.Background()
+	rr, _ := dns.NewRR("www A 127.0.0.1")
+	storage.Patch(ctx, "test", zone.DnsRecord{Id: "www", Record: rr})
+	loaded, err := storage.Load(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.UpdatedHash == "" {
+		t.Fatal("zone should have a version")
+	}
+
+	rr, _ = dns.NewRR("www A 127.0.0.2")
+	err = storage.Apply(ctx, "test", zone.Changeset{Put: []zone.DnsRecord{{Id: "www", Record: rr}}, Version: loaded.UpdatedHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes based on the old version must not be applied
+	err = storage.Apply(ctx, "test", zone.Changeset{
+		Delete:  []string{"www"},
+		Config:  &zone.ZoneConfig{AutoReverse: &zone.AutoReverse{}},
+		Version: loaded.UpdatedHash,
+	})
+	if !errors.Is(err, zone.ErrVersionMismatch) {
+		t.Fatal("expected version mismatch, got", err)
+	}
+	testZone, err := storage.Load(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(testZone.Records) != 1 || testZone.Records[0].Record.String() != rr.String() || testZone.Config.AutoReverse != nil {
+		t.Fatal("conflicting changes were applied", testZone)
+	}
+
+	storage.Clear(ctx, "test")
+}
@@ -2,14 +2,71 @@ package zone
 
 import (
 	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
+// Fallback zone files are append-only logs. They start with a header:
+//
+//	magic "DOVE" | format version (1 byte) | zone version length (uvarint) |
+//	zone version | sync time (int64 Unix seconds) | CRC32 of preceding bytes
+//
+// Zone version and sync time tell which version of the zone in primary
+// storage the file contains, and when it was written. They are empty if the
+// file has been modified after that. Format version 1 had neither.
+//
+// and continue with entries, each of which is:
+//
+//	type (1 byte) | payload length (uvarint) | payload | CRC32 of preceding bytes
+//
+// Entries are replayed in order when the zone is loaded, so the last entry
+// for a record id wins.
+const (
+	fileMagic         = "DOVE"
+	fileFormatVersion = 2
+	// Header lengths without zone version
+	fileHeaderLengthV1 = len(fileMagic) + 1 + 4
+	fileHeaderLength   = len(fileMagic) + 1 + 8 + 4
+	// Longest zone version that can be stored in header
+	maxZoneVersionLength = 256
+	// Longest header that might be needed to read zone version
+	maxFileHeaderLength = fileHeaderLength + binary.MaxVarintLen64 + maxZoneVersionLength
+)
+
+// Types of log entries
+const (
+	// Payload is record id (uvarint length + bytes) followed by the record
+	// as serialized by packRecord
+	entryPut = 1
+	// Payload is record id, without length prefix
+	entryDelete = 2
+	// Payload is zone config as JSON
+	entryConfig = 3
+)
+
+// Logs are compacted when they grow past this size, and are at least twice
+// as large as they were after previous compaction
+const compactThreshold = 64 * 1024
+
 type FileStorage struct {
 	Path string
+
+	mutex sync.Mutex
+	// Size of each zone file after it was last compacted
+	compactedSize map[string]int64
 }
 
 func NewFileStorage(path string) (*FileStorage, error) {
@@ -17,20 +74,414 @@ func NewFileStorage(path string) (*FileStorage, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create zone data directory: %v", err)
 	}
-	return &FileStorage{Path: path}, nil
+	// Clean up writes that were interrupted by a crash
+	leftovers, _ := filepath.Glob(filepath.Join(path, "*.tmp"))
+	for _, leftover := range leftovers {
+		os.Remove(leftover)
+	}
+	return &FileStorage{Path: path, compactedSize: make(map[string]int64)}, nil
+}
+
+func (storage *FileStorage) zonePath(zoneId string) string {
+	return storage.Path + "/" + zoneId
+}
+
+type fileHeader struct {
+	// Zone version (UpdatedHash) in primary storage, empty if unknown
+	version  string
+	syncedAt time.Time
+}
+
+func (header fileHeader) encode() []byte {
+	data := make([]byte, 0, fileHeaderLength+binary.MaxVarintLen64+len(header.version))
+	data = append(data, fileMagic...)
+	data = append(data, fileFormatVersion)
+	data = binary.AppendUvarint(data, uint64(len(header.version)))
+	data = append(data, header.version...)
+	var syncedAt int64
+	if !header.syncedAt.IsZero() {
+		syncedAt = header.syncedAt.Unix()
+	}
+	data = binary.BigEndian.AppendUint64(data, uint64(syncedAt))
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+}
+
+// errLegacyFormat is returned for zone files written before they had a
+// header, when they were just records one after another.
+var errLegacyFormat = errors.New("zone file has legacy format")
+
+// parseHeader reads header of a zone file, returning offset of first entry.
+func parseHeader(data []byte) (fileHeader, int, error) {
+	if len(data) == 0 {
+		return fileHeader{}, 0, fmt.Errorf("empty zone file")
+	}
+	if len(data) < len(fileMagic) || string(data[:len(fileMagic)]) != fileMagic {
+		return fileHeader{}, 0, errLegacyFormat
+	}
+	if len(data) < fileHeaderLengthV1 {
+		return fileHeader{}, 0, fmt.Errorf("truncated zone file header")
+	}
+	var header fileHeader
+	offset := len(fileMagic) + 1
+	switch data[len(fileMagic)] {
+	case 1:
+	case fileFormatVersion:
+		length, n := binary.Uvarint(data[offset:])
+		if n > 0 && length > maxZoneVersionLength {
+			return fileHeader{}, 0, fmt.Errorf("zone version in zone file header is too long")
+		}
+		remaining := len(data) - offset - n
+		if n <= 0 || remaining < 8+4 || length > uint64(remaining-8-4) {
+			return fileHeader{}, 0, fmt.Errorf("truncated zone file header")
+		}
+		offset += n
+		header.version = string(data[offset : offset+int(length)])
+		offset += int(length)
+		syncedAt := int64(binary.BigEndian.Uint64(data[offset:]))
+		if syncedAt != 0 {
+			header.syncedAt = time.Unix(syncedAt, 0)
+		}
+		offset += 8
+	default:
+		return fileHeader{}, 0, fmt.Errorf("unsupported zone file format version %d", data[len(fileMagic)])
+	}
+	if binary.BigEndian.Uint32(data[offset:]) != crc32.ChecksumIEEE(data[:offset]) {
+		return fileHeader{}, 0, fmt.Errorf("zone file header checksum mismatch")
+	}
+	return header, offset + 4, nil
+}
+
+func appendEntry(data []byte, entryType byte, payload []byte) []byte {
+	start := len(data)
+	data = append(data, entryType)
+	data = binary.AppendUvarint(data, uint64(len(payload)))
+	data = append(data, payload...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(data[start:]))
+}
+
+func putEntry(data []byte, record DnsRecord) ([]byte, error) {
+	packed, err := packRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	payload := binary.AppendUvarint(nil, uint64(len(record.Id)))
+	payload = append(payload, record.Id...)
+	payload = append(payload, packed...)
+	return appendEntry(data, entryPut, payload), nil
+}
+
+func configEntry(data []byte, config ZoneConfig) ([]byte, error) {
+	payload, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize zone config: %v", err)
+	}
+	return appendEntry(data, entryConfig, payload), nil
+}
+
+// parseLog replays a zone log, returning records in the order they were
+// first added.
+func parseLog(zoneId string, data []byte) (Zone, error) {
+	header, offset, err := parseHeader(data)
+	if err != nil {
+		return Zone{}, err
+	}
+
+	records := make([]DnsRecord, 0)
+	index := make(map[string]int) // Record id to index in records
+	var config ZoneConfig
+	for offset < len(data) {
+		start := offset
+		entryType := data[offset]
+		length, n := binary.Uvarint(data[offset+1:])
+		// Compare without adding to length, which might overflow
+		remaining := len(data) - offset - 1 - n
+		if n <= 0 || remaining < 4 || length > uint64(remaining-4) {
+			return Zone{}, fmt.Errorf("truncated zone file entry at offset %d", start)
+		}
+		offset += 1 + n
+		payload := data[offset : offset+int(length)]
+		offset += int(length)
+		if binary.BigEndian.Uint32(data[offset:]) != crc32.ChecksumIEEE(data[start:offset]) {
+			return Zone{}, fmt.Errorf("zone file entry checksum mismatch at offset %d", start)
+		}
+		offset += 4
+
+		switch entryType {
+		case entryPut:
+			idLength, n := binary.Uvarint(payload)
+			if n <= 0 || uint64(len(payload)-n) < idLength {
+				return Zone{}, fmt.Errorf("truncated record id at offset %d", start)
+			}
+			id := string(payload[n : n+int(idLength)])
+			record, end, err := unpackRecord(payload, n+int(idLength))
+			if err != nil {
+				return Zone{}, err
+			}
+			if end != len(payload) {
+				return Zone{}, fmt.Errorf("trailing data in record entry at offset %d", start)
+			}
+			record.Id = id
+			if i, ok := index[id]; ok {
+				records[i] = record
+			} else {
+				index[id] = len(records)
+				records = append(records, record)
+			}
+		case entryDelete:
+			i, ok := index[string(payload)]
+			if !ok {
+				continue
+			}
+			records = append(records[:i], records[i+1:]...)
+			delete(index, string(payload))
+			for id, j := range index {
+				if j > i {
+					index[id] = j - 1
+				}
+			}
+		case entryConfig:
+			config = ZoneConfig{}
+			err := json.Unmarshal(payload, &config)
+			if err != nil {
+				return Zone{}, fmt.Errorf("failed to parse zone config: %v", err)
+			}
+		default:
+			return Zone{}, fmt.Errorf("unknown zone file entry type %d at offset %d", entryType, start)
+		}
+	}
+
+	return Zone{
+		Name:        zoneId,
+		Records:     records,
+		UpdatedHash: header.version,
+		Config:      config,
+		SyncedAt:    header.syncedAt,
+	}, nil
 }
 
-func readVarString(data []byte, offset int) (string, int) {
-	length := int(data[offset])
-	offset++
-	return string(data[offset : offset+length]), offset + length
+// parseLegacy reads a zone file of legacy format, where each record is its
+// id (1 byte length + bytes) followed by the record in wire format.
+func parseLegacy(zoneId string, data []byte) (Zone, error) {
+	records := make([]DnsRecord, 0)
+	index := make(map[string]int) // Record id to index in records
+	for offset := 0; offset < len(data); {
+		length := int(data[offset])
+		offset++
+		if len(data)-offset < length {
+			return Zone{}, fmt.Errorf("truncated record id at offset %d", offset-1)
+		}
+		id := string(data[offset : offset+length])
+		rr, end, err := dns.UnpackRR(data, offset+length)
+		if err != nil {
+			return Zone{}, fmt.Errorf("failed to unpack DNS record: %v", err)
+		}
+		offset = end
+
+		// Records were only appended, so the last one with an id wins
+		record := DnsRecord{Id: id, Record: rr}
+		if i, ok := index[id]; ok {
+			records[i] = record
+		} else {
+			index[id] = len(records)
+			records = append(records, record)
+		}
+	}
+	return Zone{Name: zoneId, Records: records}, nil
+}
+
+// upgradeLegacy rewrites a zone file of legacy format in current format.
+// Must be called with mutex held.
+func (storage *FileStorage) upgradeLegacy(zoneId string) (Zone, error) {
+	data, err := os.ReadFile(storage.zonePath(zoneId))
+	if err != nil {
+		return Zone{}, fmt.Errorf("failed to read zone file: %v", err)
+	}
+	zone, err := parseLog(zoneId, data)
+	if !errors.Is(err, errLegacyFormat) {
+		return zone, err // Already upgraded
+	}
+	zone, err = parseLegacy(zoneId, data)
+	if err != nil {
+		return Zone{}, err
+	}
+	data, err = serializeZone(zone, time.Time{})
+	if err != nil {
+		return Zone{}, err
+	}
+	err = storage.writeAtomic(zoneId, data)
+	if err != nil {
+		return Zone{}, err
+	}
+	storage.compactedSize[zoneId] = int64(len(data))
+	slog.Info("upgraded zone file from legacy format", "zone", zoneId, "records", len(zone.Records))
+	return zone, nil
 }
 
-func writeVarString(data []byte, offset int, str string) int {
-	data[offset] = byte(len(str))
-	offset++
-	copy(data[offset:], str)
-	return offset + len(str)
+// writeLog writes entries (without header) to the end of zone log, creating
+// it if needed. The log is compacted if it has grown too large.
+func (storage *FileStorage) writeLog(zoneId string, entries []byte) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	return storage.appendLog(zoneId, entries)
+}
+
+// appendLog is writeLog that must be called with mutex held.
+func (storage *FileStorage) appendLog(zoneId string, entries []byte) error {
+	header, exists, err := storage.readHeader(zoneId)
+	if errors.Is(err, errLegacyFormat) {
+		_, err = storage.upgradeLegacy(zoneId)
+		if err == nil {
+			header, exists, err = storage.readHeader(zoneId)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if header.version != "" {
+		// File will no longer match any version of zone in primary storage
+		data, err := os.ReadFile(storage.zonePath(zoneId))
+		if err != nil {
+			return fmt.Errorf("failed to read zone file: %v", err)
+		}
+		_, offset, err := parseHeader(data)
+		if err != nil {
+			return err
+		}
+		data = append(append(fileHeader{}.encode(), data[offset:]...), entries...)
+		return storage.writeAtomic(zoneId, data)
+	}
+
+	file, err := os.OpenFile(storage.zonePath(zoneId), os.O_APPEND|os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open zone file: %v", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat zone file: %v", err)
+	}
+	if !exists || info.Size() == 0 {
+		entries = append(fileHeader{}.encode(), entries...) // New file
+	}
+	_, err = file.Write(entries)
+	if err != nil {
+		return fmt.Errorf("failed to append to zone file: %v", err)
+	}
+
+	size := info.Size() + int64(len(entries))
+	if size > compactThreshold && size > 2*storage.compactedSize[zoneId] {
+		return storage.compact(zoneId)
+	}
+	return nil
+}
+
+// readHeader reads header of a zone file, if it exists.
+func (storage *FileStorage) readHeader(zoneId string) (fileHeader, bool, error) {
+	file, err := os.Open(storage.zonePath(zoneId))
+	if errors.Is(err, fs.ErrNotExist) {
+		return fileHeader{}, false, nil
+	} else if err != nil {
+		return fileHeader{}, false, fmt.Errorf("failed to open zone file: %v", err)
+	}
+	defer file.Close()
+
+	data := make([]byte, maxFileHeaderLength)
+	n, err := io.ReadFull(file, data)
+	if n == 0 {
+		return fileHeader{}, true, nil // Empty file
+	}
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return fileHeader{}, false, fmt.Errorf("failed to read zone file: %v", err)
+	}
+	header, _, err := parseHeader(data[:n])
+	if err != nil {
+		return fileHeader{}, false, err
+	}
+	return header, true, nil
+}
+
+// compact rewrites a zone log to contain only the latest entry for each
+// record. Must be called with mutex held.
+func (storage *FileStorage) compact(zoneId string) error {
+	data, err := os.ReadFile(storage.zonePath(zoneId))
+	if err != nil {
+		return fmt.Errorf("failed to read zone file: %v", err)
+	}
+	zone, err := parseLog(zoneId, data)
+	if err != nil {
+		return fmt.Errorf("failed to compact zone file: %v", err)
+	}
+	compacted, err := serializeZone(zone, zone.SyncedAt)
+	if err != nil {
+		return err
+	}
+
+	err = storage.writeAtomic(zoneId, compacted)
+	if err != nil {
+		return err
+	}
+	storage.compactedSize[zoneId] = int64(len(compacted))
+	return nil
+}
+
+// writeAtomic replaces zone file with given data, so that after a crash the
+// file has either old or new content. Must be called with mutex held.
+func (storage *FileStorage) writeAtomic(zoneId string, data []byte) error {
+	file, err := os.CreateTemp(storage.Path, zoneId+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary zone file: %v", err)
+	}
+	tempPath := file.Name()
+	defer os.Remove(tempPath) // No-op after successful rename
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err != nil || closeErr != nil {
+		return fmt.Errorf("failed to write temporary zone file: %v", errors.Join(err, closeErr))
+	}
+	err = os.Chmod(tempPath, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to set zone file permissions: %v", err)
+	}
+
+	err = os.Rename(tempPath, storage.zonePath(zoneId))
+	if err != nil {
+		return fmt.Errorf("failed to replace zone file: %v", err)
+	}
+	// Make sure the rename itself survives a crash
+	dir, err := os.Open(storage.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open zone data directory: %v", err)
+	}
+	defer dir.Close()
+	err = dir.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync zone data directory: %v", err)
+	}
+	return nil
+}
+
+// serializeZone creates a log that contains exactly the given zone, with
+// its version in primary storage.
+func serializeZone(zone Zone, syncedAt time.Time) ([]byte, error) {
+	if len(zone.UpdatedHash) > maxZoneVersionLength {
+		return nil, fmt.Errorf("zone version is longer than %d bytes", maxZoneVersionLength)
+	}
+	header := fileHeader{version: zone.UpdatedHash, syncedAt: syncedAt}
+	data, err := configEntry(header.encode(), zone.Config)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range zone.Records {
+		data, err = putEntry(data, record)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
 }
 
 func (storage *FileStorage) ListZones(ctx context.Context) ([]string, error) {
@@ -40,8 +491,8 @@ func (storage *FileStorage) ListZones(ctx context.Context) ([]string, error) {
 	}
 	zones := make([]string, 0)
 	for _, file := range files {
-		if file.IsDir() {
-			continue
+		if file.IsDir() || strings.HasSuffix(file.Name(), ".tmp") {
+			continue // Not a zone, or an unfinished write
 		}
 		zones = append(zones, file.Name())
 	}
@@ -49,81 +500,138 @@ func (storage *FileStorage) ListZones(ctx context.Context) ([]string, error) {
 }
 
 func (storage *FileStorage) AddZone(ctx context.Context, zoneId string) error {
-	_, err := os.Create(storage.Path + "/" + zoneId)
-	return fmt.Errorf("failed to create zone: %v", err)
+	return storage.writeLog(zoneId, nil)
 }
 
 func (storage *FileStorage) DeleteZone(ctx context.Context, zoneId string) error {
-	err := os.Remove(storage.Path + "/" + zoneId)
-	return fmt.Errorf("failed to delete zone: %v", err)
+	err := os.Remove(storage.zonePath(zoneId))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete zone: %v", err)
+	}
+	return nil
 }
 
 func (storage *FileStorage) Load(ctx context.Context, zoneId string) (Zone, error) {
-	data, err := os.ReadFile(storage.Path + "/" + zoneId)
+	data, err := os.ReadFile(storage.zonePath(zoneId))
 	if err != nil {
 		return Zone{}, fmt.Errorf("failed to load zone data: %v", err)
 	}
-
-	// Read records - not delimiters needed, UnpackRR will tell us new offset
-	offset := 0
-	records := make([]DnsRecord, 0)
-	for {
-		id, end := readVarString(data, offset)
-		rr, end, err := dns.UnpackRR(data, end)
-		if err != nil {
-			return Zone{}, fmt.Errorf("failed to unpack DNS record: %v", err)
-		}
-		offset = end
-		records = append(records, DnsRecord{Id: id, Record: rr})
-		if end == len(data) {
-			break // Got to end of zone file
-		}
+	zone, err := parseLog(zoneId, data)
+	if errors.Is(err, errLegacyFormat) {
+		storage.mutex.Lock()
+		defer storage.mutex.Unlock()
+		return storage.upgradeLegacy(zoneId)
 	}
-
-	return Zone{
-		Name:    zoneId,
-		Records: records,
-	}, nil
+	return zone, err
 }
 
 func (storage *FileStorage) IsCurrent(ctx context.Context, zone *Zone) (bool, error) {
-	return true, nil // Not supported for file backend
+	if zone == nil {
+		return false, nil // Not loaded at all yet
+	}
+	header, exists, err := storage.readHeader(zone.Name)
+	if err != nil {
+		slog.Warn("unreadable fallback zone file", "zone", zone.Name, "error", err)
+		return false, nil // Replace it with something readable
+	}
+	return exists && header.version != "" && header.version == zone.UpdatedHash, nil
 }
 
 func (storage *FileStorage) Patch(ctx context.Context, zoneId string, record DnsRecord) error {
-	data := make([]byte, 1+len(record.Id)+dns.Len(record.Record))
-	offset := writeVarString(data, 0, record.Id)
-	_, err := dns.PackRR(record.Record, data, offset, nil, false)
+	entry, err := putEntry(nil, record)
 	if err != nil {
-		return fmt.Errorf("failed to pack DNS record: %v", err)
+		return err
 	}
+	return storage.writeLog(zoneId, entry)
+}
 
-	file, err := os.OpenFile(storage.Path+"/"+zoneId, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+func (storage *FileStorage) SetConfig(ctx context.Context, zoneId string, config ZoneConfig) error {
+	entry, err := configEntry(nil, config)
 	if err != nil {
-		return fmt.Errorf("failed to open zone file: %v", err)
+		return err
 	}
-	defer file.Close()
+	return storage.writeLog(zoneId, entry)
+}
 
-	_, err = file.Write(data)
-	if err != nil {
-		return fmt.Errorf("failed to append record to zone file: %v", err)
+func (storage *FileStorage) Delete(ctx context.Context, zoneId string, id string) error {
+	return storage.writeLog(zoneId, appendEntry(nil, entryDelete, []byte(id)))
+}
+
+// Apply appends all changes to zone log with one write. Zones changed
+// locally have no version, so conditional changesets only succeed on zones
+// just copied from primary storage.
+func (storage *FileStorage) Apply(ctx context.Context, zoneId string, changes Changeset) error {
+	var entries []byte
+	for _, id := range changes.Delete {
+		entries = appendEntry(entries, entryDelete, []byte(id))
 	}
-	return nil
+	for _, record := range changes.Put {
+		var err error
+		entries, err = putEntry(entries, record)
+		if err != nil {
+			return err
+		}
+	}
+	if changes.Config != nil {
+		var err error
+		entries, err = configEntry(entries, *changes.Config)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Version must not change between checking it and writing
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	if changes.Version != "" {
+		header, _, err := storage.readHeader(zoneId)
+		if err != nil {
+			return err
+		}
+		if header.version != changes.Version {
+			return ErrVersionMismatch
+		}
+	}
+	if changes.Clear {
+		// Log is started again, so nothing from before it remains
+		data := append(fileHeader{}.encode(), entries...)
+		err := storage.writeAtomic(zoneId, data)
+		if err != nil {
+			return err
+		}
+		storage.compactedSize[zoneId] = int64(len(data))
+		return nil
+	}
+	return storage.appendLog(zoneId, entries)
 }
 
-func (storage *FileStorage) Delete(ctx context.Context, zoneId string, name string) error {
-	return fmt.Errorf("not implemented")
+func (storage *FileStorage) Replace(ctx context.Context, zone Zone) error {
+	data, err := serializeZone(zone, time.Now())
+	if err != nil {
+		return err
+	}
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	err = storage.writeAtomic(zone.Name, data)
+	if err != nil {
+		return err
+	}
+	storage.compactedSize[zone.Name] = int64(len(data))
+	return nil
 }
 
 func (storage *FileStorage) Clear(ctx context.Context, zoneId string) error {
-	_, err := os.Stat(storage.Path + "/" + zoneId)
+	_, err := os.Stat(storage.zonePath(zoneId))
 	if err != nil {
 		return nil // Assume that it just didn't exist
 	}
-	err = os.Truncate(storage.Path+"/"+zoneId, 0)
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	err = os.WriteFile(storage.zonePath(zoneId), fileHeader{}.encode(), 0644)
 	if err != nil {
-		return fmt.Errorf("failed to truncate zone file: %v", err)
+		return fmt.Errorf("failed to clear zone file: %v", err)
 	}
+	delete(storage.compactedSize, zoneId)
 	return nil
 }
 
@@ -2,7 +2,14 @@ package zone_test
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/bensku/dove/zone"
 	"github.com/miekg/dns"
@@ -66,3 +73,350 @@ func TestFileStorage(t *testing.T) {
 
 	storage.Clear(ctx, "test")
 }
+
+func TestFileStorageRecordOptions(t *testing.T) {
+	storage, err := zone.NewFileStorage("/tmp/dove-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	storage.Clear(ctx, "test")
+
+	rr, _ := dns.NewRR("www A 127.0.0.1")
+	record := zone.DnsRecord{
+		Id:          "www",
+		Record:      rr,
+		HealthCheck: &zone.HealthCheck{Type: zone.HealthCheckTCP, Target: "127.0.0.1:80"},
+	}
+	err = storage.Patch(ctx, "test", record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testZone, err := storage.Load(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(testZone.Records) != 1 {
+		t.Fatal("record count should be 1, is", len(testZone.Records))
+	}
+	loaded := testZone.Records[0]
+	if loaded.Id != record.Id || loaded.Record.String() != record.Record.String() {
+		t.Fatal("wrong record", loaded)
+	}
+	if loaded.HealthCheck == nil || *loaded.HealthCheck != *record.HealthCheck {
+		t.Fatal("health check was not stored", loaded.HealthCheck)
+	}
+
+	storage.Clear(ctx, "test")
+}
+
+func TestFileStorageConfig(t *testing.T) {
+	storage, err := zone.NewFileStorage("/tmp/dove-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	storage.Clear(ctx, "test")
+
+	rr, _ := dns.NewRR("www A 127.0.0.1")
+	storage.Patch(ctx, "test", zone.DnsRecord{Id: "www", Record: rr})
+	storage.SetConfig(ctx, "test", zone.ZoneConfig{AutoReverse: &zone.AutoReverse{Ambiguous: zone.AmbiguousAll}})
+	err = storage.SetConfig(ctx, "test", zone.ZoneConfig{AutoReverse: &zone.AutoReverse{Ttl: 60}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testZone, err := storage.Load(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(testZone.Records) != 1 {
+		t.Fatal("record count should be 1, is", len(testZone.Records))
+	}
+	if testZone.Config.AutoReverse == nil || testZone.Config.AutoReverse.Ttl != 60 || testZone.Config.AutoReverse.Ambiguous != "" {
+		t.Fatal("latest config should be loaded", testZone.Config.AutoReverse)
+	}
+
+	storage.Clear(ctx, "test")
+}
+
+func TestFileStorageLog(t *testing.T) {
+	storage, err := zone.NewFileStorage("/tmp/dove-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	storage.Clear(ctx, "test")
+
+	// Later writes win, deleted records are gone
+	for _, text := range []string{"www A 127.0.0.1", "www A 127.0.0.2"} {
+		rr, _ := dns.NewRR(text)
+		storage.Patch(ctx, "test", zone.DnsRecord{Id: "www", Record: rr})
+	}
+	rr, _ := dns.NewRR("mail A 127.0.0.3")
+	storage.Patch(ctx, "test", zone.DnsRecord{Id: "mail", Record: rr})
+	err = storage.Delete(ctx, "test", "mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testZone, err := storage.Load(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(testZone.Records) != 1 || testZone.Records[0].Record.(*dns.A).A.String() != "127.0.0.2" {
+		t.Fatal("expected only latest www record, got", testZone.Records)
+	}
+
+	// Log is compacted when it grows
+	for i := range 5000 {
+		rr, _ := dns.NewRR(fmt.Sprintf("www A 127.0.%d.%d", i/256, i%256))
+		err = storage.Patch(ctx, "test", zone.DnsRecord{Id: "www", Record: rr})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := os.Stat("/tmp/dove-test/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 64*1024 {
+		t.Fatal("zone file should have been compacted, size is", info.Size())
+	}
+	testZone, err = storage.Load(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(testZone.Records) != 1 || testZone.Records[0].Record.(*dns.A).A.String() != "127.0.19.135" {
+		t.Fatal("expected latest www record after compaction, got", testZone.Records)
+	}
+
+	// Corruption is detected
+	data, _ := os.ReadFile("/tmp/dove-test/test")
+	data[len(data)-5] ^= 0xff
+	os.WriteFile("/tmp/dove-test/test", data, 0644)
+	_, err = storage.Load(ctx, "test")
+	if err == nil {
+		t.Fatal("corrupted zone file should not load")
+	}
+
+	storage.Clear(ctx, "test")
+}
+
+func TestFileStorageReplace(t *testing.T) {
+	storage, err := zone.NewFileStorage("/tmp/dove-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	rr, _ := dns.NewRR("old A 127.0.0.1")
+	storage.Patch(ctx, "test", zone.DnsRecord{Id: "old", Record: rr})
+
+	rr, _ = dns.NewRR("www A 127.0.0.2")
+	err = storage.Replace(ctx, zone.Zone{Name: "test", Records: []zone.DnsRecord{{Id: "www", Record: rr}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testZone, err := storage.Load(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(testZone.Records) != 1 || testZone.Records[0].Id != "www" {
+		t.Fatal("zone should contain only replacement records, has", testZone.Records)
+	}
+	if leftovers, _ := filepath.Glob("/tmp/dove-test/*.tmp"); len(leftovers) != 0 {
+		t.Fatal("temporary files were left behind", leftovers)
+	}
+
+	// Files truncated in middle of header or an entry are rejected
+	data, _ := os.ReadFile("/tmp/dove-test/test")
+	for length := range len(data) {
+		if length >= 18 && length < len(data)-20 {
+			continue // Might end at entry boundary
+		}
+		os.WriteFile("/tmp/dove-test/test", data[:length], 0644)
+		_, err = storage.Load(ctx, "test")
+		if err == nil {
+			t.Fatal("zone file truncated to", length, "bytes should not load")
+		}
+	}
+
+	// Corrupted entry lengths are rejected, even if they would overflow
+	entry := append(data[:18:18], 1) // Header and put entry type
+	entry = binary.AppendUvarint(entry, ^uint64(0)-1)
+	os.WriteFile("/tmp/dove-test/test", append(entry, 0, 0, 0, 0), 0644)
+	_, err = storage.Load(ctx, "test")
+	if err == nil {
+		t.Fatal("zone file with corrupted entry length should not load")
+	}
+
+	storage.Clear(ctx, "test")
+}
+
+func TestFileStorageVersion(t *testing.T) {
+	storage, err := zone.NewFileStorage("/tmp/dove-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	rr, _ := dns.NewRR("www A 127.0.0.1")
+	primaryZone := zone.Zone{Name: "test", Records: []zone.DnsRecord{{Id: "www", Record: rr}}, UpdatedHash: "42"}
+	err = storage.Replace(ctx, primaryZone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Version of primary is remembered
+	testZone, err := storage.Load(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if testZone.UpdatedHash != "42" || time.Since(testZone.SyncedAt) > time.Minute {
+		t.Fatal("unexpected version", testZone.UpdatedHash, testZone.SyncedAt)
+	}
+	current, _ := storage.IsCurrent(ctx, &primaryZone)
+	if !current {
+		t.Fatal("zone should be current")
+	}
+	primaryZone.UpdatedHash = "43"
+	current, _ = storage.IsCurrent(ctx, &primaryZone)
+	if current {
+		t.Fatal("zone with different version should not be current")
+	}
+
+	// Local changes mean that file no longer matches any primary version
+	primaryZone.UpdatedHash = "42"
+	storage.Delete(ctx, "test", "www")
+	current, _ = storage.IsCurrent(ctx, &primaryZone)
+	if current {
+		t.Fatal("modified zone should not be current")
+	}
+	testZone, err = storage.Load(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(testZone.Records) != 0 || testZone.UpdatedHash != "" {
+		t.Fatal("unexpected zone after delete", testZone.Records, testZone.UpdatedHash)
+	}
+
+	// Versions that do not fit in header are not written
+	primaryZone.UpdatedHash = strings.Repeat("x", 300)
+	err = storage.Replace(ctx, primaryZone)
+	if err == nil {
+		t.Fatal("zone with too long version should not be written")
+	}
+
+	// Corrupted version lengths are rejected, even if they would overflow
+	for _, length := range []uint64{300, ^uint64(0) - 1} {
+		header := binary.AppendUvarint([]byte("DOVE\x02"), length)
+		os.WriteFile("/tmp/dove-test/test", append(header, make([]byte, 400)...), 0644)
+		_, err = storage.Load(ctx, "test")
+		if err == nil {
+			t.Fatal("zone file with version length", length, "should not load")
+		}
+		current, err := storage.IsCurrent(ctx, &primaryZone)
+		if current || err != nil {
+			t.Fatal("corrupted zone file should be replaced, got", current, err)
+		}
+	}
+
+	storage.Clear(ctx, "test")
+}
+
+func TestFileStorageApply(t *testing.T) {
+	storage, err := zone.NewFileStorage("/tmp/dove-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testApply(t, storage)
+}
+
+// legacyEntry creates a record in format of zone files before they had
+// headers.
+func legacyEntry(id string, text string) []byte {
+	rr, _ := dns.NewRR(text)
+	data := make([]byte, 1+len(id)+dns.Len(rr))
+	data[0] = byte(len(id))
+	copy(data[1:], id)
+	dns.PackRR(rr, data, 1+len(id), nil, false)
+	return data
+}
+
+func TestFileStorageLegacy(t *testing.T) {
+	storage, err := zone.NewFileStorage("/tmp/dove-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	legacy := append(legacyEntry("www", "www A 127.0.0.1"), legacyEntry("www", "www A 127.0.0.2")...)
+	legacy = append(legacy, legacyEntry("mail", "mail A 127.0.0.3")...)
+	os.WriteFile("/tmp/dove-test/test", legacy, 0644)
+
+	// Legacy files are read and upgraded
+	testZone, err := storage.Load(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(testZone.Records) != 2 || testZone.Records[0].Record.(*dns.A).A.String() != "127.0.0.2" {
+		t.Fatal("unexpected records in legacy zone", testZone.Records)
+	}
+	data, _ := os.ReadFile("/tmp/dove-test/test")
+	if !strings.HasPrefix(string(data), "DOVE") {
+		t.Fatal("legacy zone file was not upgraded")
+	}
+
+	// Writes upgrade them, too
+	os.WriteFile("/tmp/dove-test/test", legacy, 0644)
+	err = storage.Delete(ctx, "test", "mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testZone, err = storage.Load(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(testZone.Records) != 1 || testZone.Records[0].Id != "www" {
+		t.Fatal("unexpected records after writing to legacy zone", testZone.Records)
+	}
+
+	storage.Clear(ctx, "test")
+}
+
+func TestFileStorageConcurrentApply(t *testing.T) {
+	storage, err := zone.NewFileStorage("/tmp/dove-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	rr, _ := dns.NewRR("www A 127.0.0.1")
+	for round := range 20 {
+		version := fmt.Sprint("version", round)
+		storage.Replace(ctx, zone.Zone{Name: "test", UpdatedHash: version})
+
+		// Only one of the changesets based on same version can be applied
+		results := make(chan error)
+		for i := range 5 {
+			record := zone.DnsRecord{Id: fmt.Sprint("www", i), Record: dns.Copy(rr)} // Packing modifies records
+			go func() {
+				results <- storage.Apply(ctx, "test", zone.Changeset{
+					Put:     []zone.DnsRecord{record},
+					Version: version,
+				})
+			}()
+		}
+		applied := 0
+		for range 5 {
+			err := <-results
+			if err == nil {
+				applied++
+			} else if !errors.Is(err, zone.ErrVersionMismatch) {
+				t.Fatal(err)
+			}
+		}
+		if applied != 1 {
+			t.Fatal("expected one changeset to be applied, got", applied)
+		}
+	}
+
+	storage.Clear(ctx, "test")
+}
@@ -0,0 +1,84 @@
+package zone
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	HealthCheckTCP  = "tcp"
+	HealthCheckHTTP = "http"
+	HealthCheckDNS  = "dns"
+)
+
+// HealthCheck describes how to check that the target of a record is up.
+type HealthCheck struct {
+	// One of "tcp", "http" or "dns"
+	Type string `json:"type"`
+	// Address (host:port) to connect to for tcp and dns checks, URL for http
+	Target string `json:"target"`
+
+	// Expected HTTP response status, defaults to 200
+	ExpectStatus int `json:"expectStatus,omitempty"`
+
+	// Name and type to query in dns checks; healthy if the query succeeds
+	QueryName string `json:"queryName,omitempty"`
+	QueryType string `json:"queryType,omitempty"`
+
+	// How often to check and how long to wait for response, in seconds
+	Interval int `json:"interval,omitempty"`
+	Timeout  int `json:"timeout,omitempty"`
+}
+
+// Validate checks that the health check can actually be run.
+func (check *HealthCheck) Validate() error {
+	switch check.Type {
+	case HealthCheckTCP:
+		_, _, err := net.SplitHostPort(check.Target)
+		if err != nil {
+			return fmt.Errorf("tcp health check target must be host:port: %v", err)
+		}
+	case HealthCheckHTTP:
+		target, err := url.Parse(check.Target)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") {
+			return fmt.Errorf("http health check target must be a http(s) URL")
+		}
+	case HealthCheckDNS:
+		_, _, err := net.SplitHostPort(check.Target)
+		if err != nil {
+			return fmt.Errorf("dns health check target must be host:port: %v", err)
+		}
+		if _, ok := dns.IsDomainName(check.QueryName); check.QueryName == "" || !ok {
+			return fmt.Errorf("dns health check needs a valid query name")
+		}
+		if check.QueryType != "" && dns.StringToType[check.QueryType] == 0 {
+			return fmt.Errorf("unknown query type %s", check.QueryType)
+		}
+	default:
+		return fmt.Errorf("unknown health check type '%s'", check.Type)
+	}
+	if check.Interval < 0 || check.Timeout < 0 {
+		return fmt.Errorf("interval and timeout must not be negative")
+	}
+	return nil
+}
+
+// IntervalDuration returns check interval, defaulting to 10 seconds.
+func (check *HealthCheck) IntervalDuration() time.Duration {
+	if check.Interval == 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(check.Interval) * time.Second
+}
+
+// TimeoutDuration returns check timeout, defaulting to 5 seconds.
+func (check *HealthCheck) TimeoutDuration() time.Duration {
+	if check.Timeout == 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(check.Timeout) * time.Second
+}
@@ -0,0 +1,216 @@
+package zone
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Data of a zone in memory storage; records are kept packed, so that
+// callers cannot modify stored records through their pointers.
+type memoryZone struct {
+	records     map[string][]byte
+	config      ZoneConfig
+	updatedHash string
+}
+
+// MemoryStorage keeps zones in memory of a single dove node. Data is lost
+// when dove is stopped, so it is mostly useful for testing and standalone
+// nodes whose zones are managed through the admin API.
+type MemoryStorage struct {
+	mutex   sync.RWMutex
+	zoneIds map[string]bool
+	zones   map[string]*memoryZone
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		zoneIds: make(map[string]bool),
+		zones:   make(map[string]*memoryZone),
+	}
+}
+
+// zone returns data of a zone, creating it if needed. Must be called with
+// mutex held for writing.
+func (storage *MemoryStorage) zone(zoneId string) *memoryZone {
+	data, ok := storage.zones[zoneId]
+	if !ok {
+		data = &memoryZone{records: make(map[string][]byte)}
+		storage.zones[zoneId] = data
+	}
+	return data
+}
+
+func (storage *MemoryStorage) ListZones(ctx context.Context) ([]string, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	zones := make([]string, 0, len(storage.zoneIds))
+	for zoneId := range storage.zoneIds {
+		zones = append(zones, zoneId)
+	}
+	sort.Strings(zones)
+	return zones, nil
+}
+
+func (storage *MemoryStorage) AddZone(ctx context.Context, zoneId string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.zoneIds[zoneId] = true
+	return nil
+}
+
+func (storage *MemoryStorage) DeleteZone(ctx context.Context, zoneId string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	delete(storage.zoneIds, zoneId)
+	return nil
+}
+
+func (storage *MemoryStorage) Load(ctx context.Context, zoneId string) (Zone, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	data, ok := storage.zones[zoneId]
+	if !ok {
+		return Zone{Name: zoneId, Records: make([]DnsRecord, 0)}, nil
+	}
+
+	// Same order as in etcd, sorted by record id
+	ids := make([]string, 0, len(data.records))
+	for id := range data.records {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	records := make([]DnsRecord, 0, len(ids))
+	for _, id := range ids {
+		record, _, err := unpackRecord(data.records[id], 0)
+		if err != nil {
+			return Zone{}, fmt.Errorf("failed to unpack record: %v", err)
+		}
+		record.Id = id
+		records = append(records, record)
+	}
+
+	return Zone{
+		Name:        zoneId,
+		Records:     records,
+		UpdatedHash: data.updatedHash,
+		Config:      data.config,
+	}, nil
+}
+
+func (storage *MemoryStorage) IsCurrent(ctx context.Context, zone *Zone) (bool, error) {
+	if zone == nil {
+		return false, nil // Not loaded at all yet
+	}
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	data, ok := storage.zones[zone.Name]
+	if !ok || data.updatedHash == "" {
+		return true, nil // Has never had records
+	}
+	return data.updatedHash == zone.UpdatedHash, nil
+}
+
+func (storage *MemoryStorage) Patch(ctx context.Context, zoneId string, record DnsRecord) error {
+	slog.Debug("patching record", "zone", zoneId, "id", record.Id, "record", record.Record)
+	packed, err := packRecord(record)
+	if err != nil {
+		return err
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	data := storage.zone(zoneId)
+	data.records[record.Id] = packed
+	data.updatedHash = uuid.New().String()
+	return nil
+}
+
+func (storage *MemoryStorage) Delete(ctx context.Context, zoneId string, id string) error {
+	slog.Debug("deleting record", "zone", zoneId, "id", id)
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	data := storage.zone(zoneId)
+	delete(data.records, id)
+	data.updatedHash = uuid.New().String()
+	return nil
+}
+
+func (storage *MemoryStorage) SetConfig(ctx context.Context, zoneId string, config ZoneConfig) error {
+	slog.Debug("setting zone config", "zone", zoneId, "config", config)
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	data := storage.zone(zoneId)
+	data.config = config
+	data.updatedHash = uuid.New().String()
+	return nil
+}
+
+func (storage *MemoryStorage) Replace(ctx context.Context, zone Zone) error {
+	slog.Debug("replacing zone", "zone", zone.Name, "records", len(zone.Records))
+	records := make(map[string][]byte, len(zone.Records))
+	for _, record := range zone.Records {
+		packed, err := packRecord(record)
+		if err != nil {
+			return err
+		}
+		records[record.Id] = packed
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.zones[zone.Name] = &memoryZone{
+		records:     records,
+		config:      zone.Config,
+		updatedHash: uuid.New().String(),
+	}
+	return nil
+}
+
+func (storage *MemoryStorage) Apply(ctx context.Context, zoneId string, changes Changeset) error {
+	slog.Debug("applying changeset", "zone", zoneId, "put", len(changes.Put), "delete", len(changes.Delete))
+	packed := make([][]byte, len(changes.Put))
+	for i, record := range changes.Put {
+		data, err := packRecord(record)
+		if err != nil {
+			return err
+		}
+		packed[i] = data
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	data := storage.zone(zoneId)
+	if changes.Version != "" && changes.Version != data.updatedHash {
+		return ErrVersionMismatch
+	}
+	if changes.Clear {
+		data.records = make(map[string][]byte)
+		data.config = ZoneConfig{}
+	}
+	for _, id := range changes.Delete {
+		delete(data.records, id)
+	}
+	for i, record := range changes.Put {
+		data.records[record.Id] = packed[i]
+	}
+	if changes.Config != nil {
+		data.config = *changes.Config
+	}
+	data.updatedHash = uuid.New().String()
+	return nil
+}
+
+func (storage *MemoryStorage) Clear(ctx context.Context, zoneId string) error {
+	slog.Debug("clearing zone", "zone", zoneId)
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	delete(storage.zones, zoneId)
+	return nil
+}
+
+var _ ZoneStorage = (*MemoryStorage)(nil)
@@ -0,0 +1,27 @@
+package zone_test
+
+import (
+	"testing"
+
+	"github.com/bensku/dove/zone"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, zone.NewMemoryStorage())
+}
+
+func TestMemoryZoneList(t *testing.T) {
+	testZoneList(t, zone.NewMemoryStorage())
+}
+
+func TestMemoryReplace(t *testing.T) {
+	testReplace(t, zone.NewMemoryStorage())
+}
+
+func TestMemoryApply(t *testing.T) {
+	testApply(t, zone.NewMemoryStorage())
+}
+
+func TestMemoryVersion(t *testing.T) {
+	testVersion(t, zone.NewMemoryStorage())
+}
@@ -1,11 +1,95 @@
 package zone
 
-import "github.com/miekg/dns"
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
 
 type DnsRecord struct {
 	// Id of this record, must be unique within zone
-	Id string
+	Id string `json:"-"`
 
 	// Underlying DNS record
-	Record dns.RR
+	Record dns.RR `json:"-"`
+
+	// Optional health check; record is left out of answers while it fails
+	HealthCheck *HealthCheck `json:"healthCheck,omitempty"`
+
+	// Relative weight of this record within its RRset, defaults to 1.
+	// Records with higher weight are more likely to be returned (first).
+	Weight uint16 `json:"weight,omitempty"`
+	// Maximum number of records returned from this record's RRset, 0 for
+	// no limit. If records of the RRset disagree, smallest limit is used.
+	MaxAnswers int `json:"maxAnswers,omitempty"`
+
+	// Countries (ISO 3166 codes) and continents (two-letter codes) whose
+	// clients should get this record. Clients elsewhere get records of the
+	// same RRset that have no location tags.
+	Countries  []string `json:"countries,omitempty"`
+	Continents []string `json:"continents,omitempty"`
+
+	// Split-horizon view this record belongs to, empty if it is shared by
+	// all views. Records of a view replace shared records of same name and
+	// type for clients in that view.
+	View string `json:"view,omitempty"`
+}
+
+// First byte of records that are stored with metadata. Packed DNS records
+// start with a domain name, and no label can start with this.
+const recordMetaMarker = 0xff
+
+// packRecord serializes a record (without its id) to binary format.
+// Records without metadata are stored as plain packed DNS records.
+func packRecord(record DnsRecord) ([]byte, error) {
+	if record.Record == nil {
+		return nil, fmt.Errorf("missing DNS record")
+	}
+	meta, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize record metadata: %v", err)
+	}
+	if string(meta) == "{}" {
+		meta = nil // Nothing to store
+	}
+
+	data := make([]byte, 1+binary.MaxVarintLen64+len(meta)+dns.Len(record.Record))
+	offset := 0
+	if meta != nil {
+		data[0] = recordMetaMarker
+		offset = 1 + binary.PutUvarint(data[1:], uint64(len(meta)))
+		offset += copy(data[offset:], meta)
+	}
+	end, err := dns.PackRR(record.Record, data, offset, nil, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack DNS record: %v", err)
+	}
+	return data[:end], nil
+}
+
+// unpackRecord reads a record serialized with packRecord, starting at given
+// offset. The record id is not filled in. Returns offset after the record.
+func unpackRecord(data []byte, offset int) (DnsRecord, int, error) {
+	var record DnsRecord
+	if offset < len(data) && data[offset] == recordMetaMarker {
+		length, n := binary.Uvarint(data[offset+1:])
+		if n <= 0 || uint64(len(data)-offset-1-n) < length {
+			return DnsRecord{}, 0, fmt.Errorf("truncated record metadata")
+		}
+		offset += 1 + n
+		err := json.Unmarshal(data[offset:offset+int(length)], &record)
+		if err != nil {
+			return DnsRecord{}, 0, fmt.Errorf("failed to parse record metadata: %v", err)
+		}
+		offset += int(length)
+	}
+
+	rr, end, err := dns.UnpackRR(data, offset)
+	if err != nil {
+		return DnsRecord{}, 0, fmt.Errorf("failed to unpack DNS record: %v", err)
+	}
+	record.Record = rr
+	return record, end, nil
 }
@@ -4,6 +4,8 @@ import (
 	"context"
 	"log/slog"
 	"slices"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -13,14 +15,41 @@ type ZoneServer struct {
 	primary  ZoneStorage
 	fallback ZoneStorage
 
+	// Protects zone maps, which are read by DNS and admin API handlers
+	mutex         sync.RWMutex
 	ZoneIds       []string
 	Zones         map[string]*Zone
 	onZoneUpdated func(name string, zone *Zone)
 
+	// When each zone was last successfully checked against primary storage
+	refreshed      map[string]time.Time
+	staleThreshold time.Duration
+
 	refreshTicker *time.Ticker
 }
 
+// ZoneStatus describes how fresh the data of a loaded zone is.
+type ZoneStatus struct {
+	Name string `json:"name"`
+	// When the zone was last successfully checked against primary storage,
+	// nil if that is not known (e.g. zone was loaded from an old fallback file)
+	LastRefresh *time.Time `json:"lastRefresh"`
+	// Seconds since last successful refresh, -1 if never refreshed
+	AgeSeconds float64 `json:"ageSeconds"`
+	Stale      bool    `json:"stale"`
+}
+
 func (s *ZoneServer) loadZones(fallback bool) error {
+	start := time.Now()
+	err := s.doLoadZones(fallback)
+	refreshDuration.WithLabelValues(sourceLabel(fallback)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		refreshFailures.WithLabelValues(sourceLabel(fallback)).Inc()
+	}
+	return err
+}
+
+func (s *ZoneServer) doLoadZones(fallback bool) error {
 	ctx, cancelFunc := context.WithTimeout(s.context, 10*time.Second)
 	defer cancelFunc()
 
@@ -36,42 +65,80 @@ func (s *ZoneServer) loadZones(fallback bool) error {
 	if err != nil {
 		return err
 	}
+	s.mutex.Lock()
 	oldZoneIds := s.ZoneIds
 	s.ZoneIds = zoneIds
+	s.mutex.Unlock()
 
 	// Update the loaded zones
-	for _, zoneId := range s.ZoneIds {
-		current, err := storage.IsCurrent(ctx, s.Zones[zoneId])
+	for _, zoneId := range zoneIds {
+		s.mutex.RLock()
+		loaded := s.Zones[zoneId]
+		s.mutex.RUnlock()
+		current, err := storage.IsCurrent(ctx, loaded)
 		if err != nil {
 			return err
 		}
 		if !current {
 			// Newer zone available
+			loadStart := time.Now()
 			zone, err := storage.Load(ctx, zoneId)
+			loadDuration.WithLabelValues(zoneId, sourceLabel(fallback)).Observe(time.Since(loadStart).Seconds())
 			if err != nil {
+				loadFailures.WithLabelValues(zoneId, sourceLabel(fallback)).Inc()
+				if fallback {
+					// One unreadable file must not prevent serving other zones
+					slog.Error("failed to load zone from fallback", "zoneId", zoneId, "error", err)
+					continue
+				}
 				return err
 			}
+			s.mutex.Lock()
 			s.Zones[zoneId] = &zone
+			if fallback && !zone.SyncedAt.IsZero() {
+				// Fallback data is as fresh as the primary was when it was copied
+				s.refreshed[zoneId] = zone.SyncedAt
+			}
+			s.mutex.Unlock()
 
 			// Notify listener
 			if s.onZoneUpdated != nil {
-				s.onZoneUpdated(zoneId, s.Zones[zoneId])
+				s.onZoneUpdated(zoneId, &zone)
 			}
 
 			// Transfer to local storage in case we lose etcd
-			InternalTransfer(ctx, zone, s.fallback)
+			if !fallback {
+				err = InternalTransfer(ctx, zone, s.fallback)
+				if err != nil {
+					slog.Error("failed to save zone to fallback storage", "zoneId", zoneId, "error", err)
+				}
+			}
 
-			slog.Info("loaded zone", "zoneId", zoneId)
+			slog.Info("loaded zone", "zoneId", zoneId, "fallback", fallback)
+		}
+		if !fallback {
+			// Zone is known to match primary now, whether it was reloaded or not
+			s.mutex.Lock()
+			s.refreshed[zoneId] = time.Now()
+			s.mutex.Unlock()
 		}
 		slog.Debug("checked zone for update", "zoneId", zoneId, "updated", !current)
 	}
 
+	if !fallback {
+		s.pruneFallback(ctx, zoneIds)
+	}
+
 	// Check if we removed any zones and call listener for them
 	for _, zoneId := range oldZoneIds {
 		if !slices.Contains(zoneIds, zoneId) {
 			if s.onZoneUpdated != nil {
+				s.mutex.Lock()
 				delete(s.Zones, zoneId)
+				delete(s.refreshed, zoneId)
+				s.mutex.Unlock()
 				s.onZoneUpdated(zoneId, nil)
+				forgetZoneMetrics(zoneId)
 				slog.Info("unloaded zone", "zoneId", zoneId)
 			}
 		}
@@ -80,7 +147,40 @@ func (s *ZoneServer) loadZones(fallback bool) error {
 	return nil
 }
 
+// pruneFallback deletes zones that no longer exist in primary storage from
+// fallback storage. Zones that exist but are broken in primary are kept,
+// as the fallback copy may be the only valid version of them.
+func (s *ZoneServer) pruneFallback(ctx context.Context, zoneIds []string) {
+	fallbackIds, err := s.fallback.ListZones(ctx)
+	if err != nil {
+		slog.Error("failed to list fallback zones", "error", err)
+		return
+	}
+	var brokenIds []string
+	if lister, ok := s.primary.(BrokenZoneLister); ok {
+		brokenIds, err = lister.BrokenZones(ctx)
+		if err != nil {
+			slog.Error("failed to list broken zones", "error", err)
+			return
+		}
+	}
+	for _, zoneId := range fallbackIds {
+		if !slices.Contains(zoneIds, zoneId) && !slices.Contains(brokenIds, zoneId) {
+			err = s.fallback.DeleteZone(ctx, zoneId)
+			if err != nil {
+				slog.Error("failed to prune fallback zone", "zoneId", zoneId, "error", err)
+				continue
+			}
+			slog.Info("pruned fallback zone", "zoneId", zoneId)
+		}
+	}
+}
+
 func (s *ZoneServer) zoneRefresher() {
+	var changes <-chan string
+	if notifier, ok := s.primary.(ChangeNotifier); ok {
+		changes = notifier.Changes(s.context)
+	}
 	for {
 		select {
 		case <-s.refreshTicker.C:
@@ -88,26 +188,84 @@ func (s *ZoneServer) zoneRefresher() {
 			if err != nil {
 				slog.Error("failed to refresh zones from primary, serving stale data!", "error", err)
 			}
+		case zoneId := <-changes:
+			slog.Debug("zone changed in primary", "zoneId", zoneId)
+			err := s.loadZones(false)
+			if err != nil {
+				slog.Error("failed to refresh zones from primary, serving stale data!", "error", err)
+			}
 		case <-s.context.Done():
 			return
 		}
 	}
 }
 
+// LoadedZones returns all zones that are currently being served. Zones are
+// never modified after loading, so callers may keep using them.
+func (s *ZoneServer) LoadedZones() []*Zone {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	zones := make([]*Zone, 0, len(s.Zones))
+	for _, zone := range s.Zones {
+		zones = append(zones, zone)
+	}
+	return zones
+}
+
+// IsStale checks whether the given zone has not been successfully refreshed
+// from primary storage within the stale threshold. Zones that were loaded
+// from fallback storage count as refreshed when they were copied from the
+// primary; if that is not known, they are always stale.
+func (s *ZoneServer) IsStale(zoneId string) bool {
+	if s.staleThreshold <= 0 {
+		return false // Staleness tracking disabled
+	}
+	s.mutex.RLock()
+	refreshed, ok := s.refreshed[zoneId]
+	s.mutex.RUnlock()
+	return !ok || time.Since(refreshed) > s.staleThreshold
+}
+
+// Status returns freshness information of all loaded zones, sorted by name.
+func (s *ZoneServer) Status() []ZoneStatus {
+	s.mutex.RLock()
+	statuses := make([]ZoneStatus, 0, len(s.Zones))
+	for zoneId := range s.Zones {
+		status := ZoneStatus{Name: zoneId, AgeSeconds: -1}
+		if refreshed, ok := s.refreshed[zoneId]; ok {
+			status.LastRefresh = &refreshed
+			status.AgeSeconds = time.Since(refreshed).Seconds()
+		}
+		statuses = append(statuses, status)
+	}
+	s.mutex.RUnlock()
+
+	for i := range statuses {
+		statuses[i].Stale = s.IsStale(statuses[i].Name)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
 func (s *ZoneServer) Close() {
 	s.refreshTicker.Stop()
 }
 
 func NewZoneServer(ctx context.Context, primary ZoneStorage, fallback ZoneStorage,
-	onZoneUpdated func(name string, zone *Zone), refreshInterval time.Duration) *ZoneServer {
+	onZoneUpdated func(name string, zone *Zone), refreshInterval time.Duration,
+	staleThreshold time.Duration) *ZoneServer {
 	server := &ZoneServer{
-		ZoneIds:       make([]string, 0),
-		context:       ctx,
-		primary:       primary,
-		fallback:      fallback,
-		Zones:         make(map[string]*Zone),
-		onZoneUpdated: onZoneUpdated,
-		refreshTicker: time.NewTicker(refreshInterval),
+		ZoneIds:        make([]string, 0),
+		context:        ctx,
+		primary:        primary,
+		fallback:       fallback,
+		Zones:          make(map[string]*Zone),
+		onZoneUpdated:  onZoneUpdated,
+		refreshed:      make(map[string]time.Time),
+		staleThreshold: staleThreshold,
+		refreshTicker:  time.NewTicker(refreshInterval),
 	}
 
 	// Initial zone load
@@ -0,0 +1,71 @@
+package zone_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bensku/dove/zone"
+	"github.com/miekg/dns"
+)
+
+// Primary storage that cannot be reached
+type unavailableStorage struct {
+	zone.ZoneStorage
+}
+
+func (storage unavailableStorage) ListZones(ctx context.Context) ([]string, error) {
+	return nil, errors.New("primary storage is unavailable")
+}
+
+func TestServerFallback(t *testing.T) {
+	dir := t.TempDir()
+	fallback, err := zone.NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	rr, _ := dns.NewRR("www A 127.0.0.1")
+	fallback.Replace(ctx, zone.Zone{Name: "good.", Records: []zone.DnsRecord{{Id: "www", Record: rr}}, UpdatedHash: "42"})
+	os.WriteFile(filepath.Join(dir, "broken."), []byte("DOVE\x02garbage"), 0644)
+
+	// Unreadable zone files do not prevent loading others
+	server := zone.NewZoneServer(ctx, unavailableStorage{}, fallback, nil, time.Hour, time.Hour)
+	defer server.Close()
+	if server.Zones["good."] == nil || len(server.Zones["good."].Records) != 1 {
+		t.Fatal("readable zone should be loaded from fallback", server.Zones)
+	}
+	if server.Zones["broken."] != nil {
+		t.Fatal("broken zone should not be loaded")
+	}
+}
+
+func TestServerBrokenPrimary(t *testing.T) {
+	zoneDir := t.TempDir()
+	os.WriteFile(filepath.Join(zoneDir, "dove.test.zone"), []byte("broken IN BOGUS 1\n"), 0644)
+	primary, err := zone.NewDirectoryStorage(zoneDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fallback, err := zone.NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	rr, _ := dns.NewRR("www.dove.test. A 127.0.0.1")
+	fallback.Replace(ctx, zone.Zone{Name: "dove.test.", Records: []zone.DnsRecord{{Id: "www", Record: rr}}, UpdatedHash: "42"})
+	fallback.Replace(ctx, zone.Zone{Name: "removed.test.", UpdatedHash: "1"})
+
+	// Fallback copies of zones with broken files are not pruned
+	server := zone.NewZoneServer(ctx, primary, fallback, nil, time.Hour, time.Hour)
+	defer server.Close()
+	zoneIds, _ := fallback.ListZones(ctx)
+	if len(zoneIds) != 1 || zoneIds[0] != "dove.test." {
+		t.Fatal("unexpected fallback zones", zoneIds)
+	}
+}
@@ -0,0 +1,511 @@
+package zone
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// Channel that PostgreSQL notifications of changed zones are sent to
+const sqlNotifyChannel = "dove_zones"
+
+// Schema migrations, applied in order. {{binary}} is replaced by binary data
+// type of the database.
+var sqlMigrations = []string{
+	`CREATE TABLE dove_zones (
+		name TEXT PRIMARY KEY,
+		listed INTEGER NOT NULL DEFAULT 0,
+		version BIGINT NOT NULL DEFAULT 0,
+		config TEXT
+	)`,
+	`CREATE TABLE dove_records (
+		zone TEXT NOT NULL,
+		id TEXT NOT NULL,
+		data {{binary}} NOT NULL,
+		PRIMARY KEY (zone, id)
+	)`,
+}
+
+// Differences between supported databases.
+type sqlDialect struct {
+	// Whether parameters are $1, $2, ... instead of ?
+	numberedParams bool
+	binaryType     string
+	// Whether LISTEN/NOTIFY is supported
+	notify bool
+	// Whether database allows only one writer at a time
+	singleWriter bool
+	// Statement that makes concurrent schema migrations, e.g. by nodes
+	// starting at the same time, wait for each other; empty if not needed
+	migrationLock string
+}
+
+var sqlDialects = map[string]sqlDialect{
+	"sqlite": {binaryType: "BLOB", singleWriter: true},
+	// Advisory lock key is "dove" in ASCII
+	"postgres": {numberedParams: true, binaryType: "BYTEA", notify: true, migrationLock: "SELECT pg_advisory_xact_lock(1685026405)"},
+}
+
+// SqlStorage stores zones in a SQL database. Every zone has a version that
+// is incremented on each change, so polling nodes only need to check it.
+// With PostgreSQL, changes are also announced with NOTIFY.
+type SqlStorage struct {
+	db      *sql.DB
+	dialect sqlDialect
+	dsn     string
+}
+
+// NewSqlStorage connects to a database with given driver (sqlite or postgres)
+// and brings its schema up to date.
+func NewSqlStorage(ctx context.Context, driver string, dsn string) (*SqlStorage, error) {
+	dialect, ok := sqlDialects[driver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported SQL driver %s", driver)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	if dialect.singleWriter {
+		db.SetMaxOpenConns(1) // Avoid failing on locked database
+	}
+	storage := &SqlStorage{
+		db:      db,
+		dialect: dialect,
+		dsn:     dsn,
+	}
+	err = storage.migrate(ctx)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return storage, nil
+}
+
+// query adapts a query written with ? parameters to the database.
+func (storage *SqlStorage) query(query string) string {
+	if !storage.dialect.numberedParams {
+		return query
+	}
+	var result strings.Builder
+	param := 0
+	for _, c := range query {
+		if c == '?' {
+			param++
+			result.WriteString("$" + strconv.Itoa(param))
+		} else {
+			result.WriteRune(c)
+		}
+	}
+	return result.String()
+}
+
+// migrate applies schema migrations that have not been applied yet.
+func (storage *SqlStorage) migrate(ctx context.Context) error {
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// Lock is released when transaction ends
+	if storage.dialect.migrationLock != "" {
+		_, err = tx.ExecContext(ctx, storage.dialect.migrationLock)
+		if err != nil {
+			return fmt.Errorf("failed to lock schema: %v", err)
+		}
+	}
+	_, err = tx.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS dove_schema (version INTEGER NOT NULL)")
+	if err != nil {
+		return fmt.Errorf("failed to create schema table: %v", err)
+	}
+	var version int
+	err = tx.QueryRowContext(ctx, "SELECT version FROM dove_schema").Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		_, err = tx.ExecContext(ctx, "INSERT INTO dove_schema (version) VALUES (0)")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check schema version: %v", err)
+	}
+	if version > len(sqlMigrations) {
+		return fmt.Errorf("database schema version %d is newer than supported %d", version, len(sqlMigrations))
+	}
+	for i, migration := range sqlMigrations[version:] {
+		migration = strings.ReplaceAll(migration, "{{binary}}", storage.dialect.binaryType)
+		_, err = tx.ExecContext(ctx, migration)
+		if err != nil {
+			return fmt.Errorf("failed to apply schema migration %d: %v", version+i+1, err)
+		}
+		slog.Info("applied schema migration", "version", version+i+1)
+	}
+	_, err = tx.ExecContext(ctx, storage.query("UPDATE dove_schema SET version = ?"), len(sqlMigrations))
+	if err != nil {
+		return fmt.Errorf("failed to update schema version: %v", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to migrate schema: %v", err)
+	}
+	return nil
+}
+
+// update runs a function in a transaction, and then marks the zone as
+// updated by incrementing its version.
+func (storage *SqlStorage) update(ctx context.Context, zoneId string, update func(tx *sql.Tx) error) error {
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, storage.query(`INSERT INTO dove_zones (name, version) VALUES (?, 1)
+		ON CONFLICT (name) DO UPDATE SET version = dove_zones.version + 1`), zoneId)
+	if err != nil {
+		return fmt.Errorf("failed to update zone version: %v", err)
+	}
+	err = update(tx)
+	if err != nil {
+		return err
+	}
+	if storage.dialect.notify {
+		_, err = tx.ExecContext(ctx, storage.query("SELECT pg_notify(?, ?)"), sqlNotifyChannel, zoneId)
+		if err != nil {
+			return fmt.Errorf("failed to notify of zone update: %v", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+func (storage *SqlStorage) ListZones(ctx context.Context) ([]string, error) {
+	rows, err := storage.db.QueryContext(ctx, "SELECT name FROM dove_zones WHERE listed = 1 ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list zones: %v", err)
+	}
+	defer rows.Close()
+	zones := make([]string, 0)
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list zones: %v", err)
+		}
+		zones = append(zones, name)
+	}
+	return zones, rows.Err()
+}
+
+func (storage *SqlStorage) setListed(ctx context.Context, zoneId string, listed int) error {
+	_, err := storage.db.ExecContext(ctx, storage.query(`INSERT INTO dove_zones (name, listed) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET listed = excluded.listed`), zoneId, listed)
+	if err == nil && storage.dialect.notify {
+		_, err = storage.db.ExecContext(ctx, storage.query("SELECT pg_notify(?, ?)"), sqlNotifyChannel, zoneId)
+	}
+	return err
+}
+
+func (storage *SqlStorage) AddZone(ctx context.Context, zoneId string) error {
+	err := storage.setListed(ctx, zoneId, 1)
+	if err != nil {
+		return fmt.Errorf("failed to add zone: %v", err)
+	}
+	return nil
+}
+
+func (storage *SqlStorage) DeleteZone(ctx context.Context, zoneId string) error {
+	err := storage.setListed(ctx, zoneId, 0)
+	if err != nil {
+		return fmt.Errorf("failed to delete zone: %v", err)
+	}
+	return nil
+}
+
+func (storage *SqlStorage) Load(ctx context.Context, zoneId string) (Zone, error) {
+	// Read records and version consistently
+	var options *sql.TxOptions
+	if !storage.dialect.singleWriter {
+		options = &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+	}
+	tx, err := storage.db.BeginTx(ctx, options)
+	if err != nil {
+		return Zone{}, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var version int64
+	var configData sql.NullString
+	err = tx.QueryRowContext(ctx, storage.query("SELECT version, config FROM dove_zones WHERE name = ?"), zoneId).Scan(&version, &configData)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Zone{}, fmt.Errorf("failed to lookup zone: %v", err)
+	}
+	var config ZoneConfig
+	if configData.Valid {
+		err = json.Unmarshal([]byte(configData.String), &config)
+		if err != nil {
+			return Zone{}, fmt.Errorf("failed to parse zone config: %v", err)
+		}
+	}
+
+	rows, err := tx.QueryContext(ctx, storage.query("SELECT id, data FROM dove_records WHERE zone = ? ORDER BY id"), zoneId)
+	if err != nil {
+		return Zone{}, fmt.Errorf("failed to lookup zone: %v", err)
+	}
+	defer rows.Close()
+	records := make([]DnsRecord, 0)
+	for rows.Next() {
+		var id string
+		var data []byte
+		err = rows.Scan(&id, &data)
+		if err != nil {
+			return Zone{}, fmt.Errorf("failed to lookup zone: %v", err)
+		}
+		record, _, err := unpackRecord(data, 0)
+		if err != nil {
+			return Zone{}, fmt.Errorf("failed to unpack record: %v", err)
+		}
+		record.Id = id
+		records = append(records, record)
+	}
+	if rows.Err() != nil {
+		return Zone{}, fmt.Errorf("failed to lookup zone: %v", rows.Err())
+	}
+
+	updatedHash := ""
+	if version != 0 {
+		updatedHash = strconv.FormatInt(version, 10)
+	}
+	return Zone{
+		Name:        zoneId,
+		Records:     records,
+		UpdatedHash: updatedHash,
+		Config:      config,
+	}, nil
+}
+
+func (storage *SqlStorage) IsCurrent(ctx context.Context, zone *Zone) (bool, error) {
+	if zone == nil {
+		return false, nil // Not loaded at all yet
+	}
+	var version int64
+	err := storage.db.QueryRowContext(ctx, storage.query("SELECT version FROM dove_zones WHERE name = ?"), zone.Name).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && version == 0) {
+		return true, nil // Has never had records
+	} else if err != nil {
+		return false, fmt.Errorf("failed to lookup zone version: %v", err)
+	}
+	return strconv.FormatInt(version, 10) == zone.UpdatedHash, nil
+}
+
+func (storage *SqlStorage) Patch(ctx context.Context, zoneId string, record DnsRecord) error {
+	slog.Debug("patching record", "zone", zoneId, "id", record.Id, "record", record.Record)
+	data, err := packRecord(record)
+	if err != nil {
+		return err
+	}
+	return storage.update(ctx, zoneId, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, storage.query(`INSERT INTO dove_records (zone, id, data) VALUES (?, ?, ?)
+			ON CONFLICT (zone, id) DO UPDATE SET data = excluded.data`), zoneId, record.Id, data)
+		if err != nil {
+			return fmt.Errorf("failed to patch record: %v", err)
+		}
+		return nil
+	})
+}
+
+func (storage *SqlStorage) Delete(ctx context.Context, zoneId string, id string) error {
+	slog.Debug("deleting record", "zone", zoneId, "id", id)
+	return storage.update(ctx, zoneId, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, storage.query("DELETE FROM dove_records WHERE zone = ? AND id = ?"), zoneId, id)
+		if err != nil {
+			return fmt.Errorf("failed to delete record: %v", err)
+		}
+		return nil
+	})
+}
+
+func (storage *SqlStorage) SetConfig(ctx context.Context, zoneId string, config ZoneConfig) error {
+	slog.Debug("setting zone config", "zone", zoneId, "config", config)
+	data, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to serialize zone config: %v", err)
+	}
+	return storage.update(ctx, zoneId, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, storage.query("UPDATE dove_zones SET config = ? WHERE name = ?"), string(data), zoneId)
+		if err != nil {
+			return fmt.Errorf("failed to set zone config: %v", err)
+		}
+		return nil
+	})
+}
+
+func (storage *SqlStorage) Replace(ctx context.Context, zone Zone) error {
+	slog.Debug("replacing zone", "zone", zone.Name, "records", len(zone.Records))
+	config, err := json.Marshal(zone.Config)
+	if err != nil {
+		return fmt.Errorf("failed to serialize zone config: %v", err)
+	}
+	return storage.update(ctx, zone.Name, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, storage.query("DELETE FROM dove_records WHERE zone = ?"), zone.Name)
+		if err != nil {
+			return fmt.Errorf("failed to replace zone: %v", err)
+		}
+		insert, err := tx.PrepareContext(ctx, storage.query("INSERT INTO dove_records (zone, id, data) VALUES (?, ?, ?)"))
+		if err != nil {
+			return fmt.Errorf("failed to replace zone: %v", err)
+		}
+		defer insert.Close()
+		for _, record := range zone.Records {
+			data, err := packRecord(record)
+			if err != nil {
+				return err
+			}
+			_, err = insert.ExecContext(ctx, zone.Name, record.Id, data)
+			if err != nil {
+				return fmt.Errorf("failed to replace zone: %v", err)
+			}
+		}
+		_, err = tx.ExecContext(ctx, storage.query("UPDATE dove_zones SET config = ? WHERE name = ?"), string(config), zone.Name)
+		if err != nil {
+			return fmt.Errorf("failed to replace zone: %v", err)
+		}
+		return nil
+	})
+}
+
+func (storage *SqlStorage) Apply(ctx context.Context, zoneId string, changes Changeset) error {
+	slog.Debug("applying changeset", "zone", zoneId, "put", len(changes.Put), "delete", len(changes.Delete))
+	packed := make([][]byte, len(changes.Put))
+	for i, record := range changes.Put {
+		data, err := packRecord(record)
+		if err != nil {
+			return err
+		}
+		packed[i] = data
+	}
+	var config []byte
+	if changes.Config != nil {
+		var err error
+		config, err = json.Marshal(changes.Config)
+		if err != nil {
+			return fmt.Errorf("failed to serialize zone config: %v", err)
+		}
+	}
+	return storage.update(ctx, zoneId, func(tx *sql.Tx) error {
+		if changes.Version != "" {
+			// Version was already incremented in this transaction
+			var version int64
+			err := tx.QueryRowContext(ctx, storage.query("SELECT version FROM dove_zones WHERE name = ?"), zoneId).Scan(&version)
+			if err != nil {
+				return fmt.Errorf("failed to lookup zone version: %v", err)
+			}
+			if strconv.FormatInt(version-1, 10) != changes.Version {
+				return ErrVersionMismatch
+			}
+		}
+		if changes.Clear {
+			_, err := tx.ExecContext(ctx, storage.query("DELETE FROM dove_records WHERE zone = ?"), zoneId)
+			if err != nil {
+				return fmt.Errorf("failed to clear zone: %v", err)
+			}
+			_, err = tx.ExecContext(ctx, storage.query("UPDATE dove_zones SET config = NULL WHERE name = ?"), zoneId)
+			if err != nil {
+				return fmt.Errorf("failed to clear zone: %v", err)
+			}
+		}
+		if config != nil {
+			_, err := tx.ExecContext(ctx, storage.query("UPDATE dove_zones SET config = ? WHERE name = ?"), string(config), zoneId)
+			if err != nil {
+				return fmt.Errorf("failed to set zone config: %v", err)
+			}
+		}
+		for _, id := range changes.Delete {
+			_, err := tx.ExecContext(ctx, storage.query("DELETE FROM dove_records WHERE zone = ? AND id = ?"), zoneId, id)
+			if err != nil {
+				return fmt.Errorf("failed to apply changeset: %v", err)
+			}
+		}
+		for i, record := range changes.Put {
+			_, err := tx.ExecContext(ctx, storage.query(`INSERT INTO dove_records (zone, id, data) VALUES (?, ?, ?)
+				ON CONFLICT (zone, id) DO UPDATE SET data = excluded.data`), zoneId, record.Id, packed[i])
+			if err != nil {
+				return fmt.Errorf("failed to apply changeset: %v", err)
+			}
+		}
+		return nil
+	})
+}
+
+func (storage *SqlStorage) Clear(ctx context.Context, zoneId string) error {
+	slog.Debug("clearing zone", "zone", zoneId)
+	// Version is incremented rather than removed, so that nodes notice that
+	// the zone was cleared
+	return storage.update(ctx, zoneId, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, storage.query("DELETE FROM dove_records WHERE zone = ?"), zoneId)
+		if err != nil {
+			return fmt.Errorf("failed to clear zone: %v", err)
+		}
+		_, err = tx.ExecContext(ctx, storage.query("UPDATE dove_zones SET config = NULL WHERE name = ?"), zoneId)
+		if err != nil {
+			return fmt.Errorf("failed to clear zone: %v", err)
+		}
+		return nil
+	})
+}
+
+// Changes returns a channel that receives names of changed zones until
+// context is done. Empty name means that changes may have been missed,
+// e.g. due to connection loss. If the database does not support change
+// notifications, channel is nil.
+func (storage *SqlStorage) Changes(ctx context.Context) <-chan string {
+	if !storage.dialect.notify {
+		return nil
+	}
+	changes := make(chan string, 16)
+	listener := pq.NewListener(storage.dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			slog.Warn("zone change listener", "event", event, "error", err)
+		}
+	})
+	err := listener.Listen(sqlNotifyChannel)
+	if err != nil {
+		slog.Error("failed to listen for zone changes", "error", err)
+	}
+	go func() {
+		defer listener.Close()
+		for {
+			select {
+			case notification := <-listener.Notify:
+				name := "" // Reconnected, something may have changed
+				if notification != nil {
+					name = notification.Extra
+				}
+				select {
+				case changes <- name:
+				default: // Full, zones will be reloaded anyway
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return changes
+}
+
+func (storage *SqlStorage) Close() error {
+	return storage.db.Close()
+}
+
+var _ ZoneStorage = (*SqlStorage)(nil)
+var _ ChangeNotifier = (*SqlStorage)(nil)
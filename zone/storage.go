@@ -2,6 +2,7 @@ package zone
 
 import (
 	"context"
+	"errors"
 	"fmt"
 )
 
@@ -15,18 +16,93 @@ type ZoneStorage interface {
 	Patch(ctx context.Context, zoneId string, record DnsRecord) error
 	Delete(ctx context.Context, zoneId string, id string) error
 	Clear(ctx context.Context, zoneId string) error
+	SetConfig(ctx context.Context, zoneId string, config ZoneConfig) error
+	// Replace sets content of zone to exactly the given records and config.
+	Replace(ctx context.Context, zone Zone) error
+	// Apply makes all changes of a changeset at once, as one update.
+	Apply(ctx context.Context, zoneId string, changes Changeset) error
 }
 
+// ErrChangesetTooLarge is returned when storage cannot apply a changeset
+// at once because of its size.
+var ErrChangesetTooLarge = errors.New("changeset too large")
+
+// ErrVersionMismatch is returned when a changeset is not applied, because
+// the zone has been changed after the version it was based on.
+var ErrVersionMismatch = errors.New("zone version does not match")
+
+// Changeset is a batch of record changes. Deletes are applied before puts.
+type Changeset struct {
+	Put    []DnsRecord
+	Delete []string
+	// If set, all records and config of zone are deleted before puts
+	Clear bool
+	// New zone config, or nil to keep the current one
+	Config *ZoneConfig
+	// If not empty, changes are applied only if zone has this version
+	// (UpdatedHash); otherwise ErrVersionMismatch is returned
+	Version string
+	// If set, changesets too large to write at once may be written in
+	// several steps, so that zone is marked as updated only after the last
+	// one. Others can see the zone partially changed in the meanwhile.
+	Staged bool
+}
+
+// normalized returns changeset where every record id appears only once,
+// as it would after applying the changes in order.
+func (changes Changeset) normalized() Changeset {
+	result := Changeset{Clear: changes.Clear, Config: changes.Config, Version: changes.Version, Staged: changes.Staged}
+	put := make(map[string]int)
+	for _, record := range changes.Put {
+		if i, ok := put[record.Id]; ok {
+			result.Put[i] = record // Later put wins
+		} else {
+			put[record.Id] = len(result.Put)
+			result.Put = append(result.Put, record)
+		}
+	}
+	if changes.Clear {
+		return result // Everything else is deleted anyway
+	}
+	deleted := make(map[string]bool)
+	for _, id := range changes.Delete {
+		if _, ok := put[id]; !ok && !deleted[id] {
+			deleted[id] = true
+			result.Delete = append(result.Delete, id)
+		}
+	}
+	return result
+}
+
+// ChangeNotifier is implemented by storages that can announce changes of
+// zones, so that they can be reloaded without waiting for next refresh.
+type ChangeNotifier interface {
+	// Changes returns a channel that receives names of changed zones until
+	// context is done, or nil if changes cannot be announced.
+	Changes(ctx context.Context) <-chan string
+}
+
+// BrokenZoneLister is implemented by storages where a zone may exist
+// without any valid content to serve, e.g. because its zone file is broken.
+// Such zones are not listed, but they must not be treated as removed.
+type BrokenZoneLister interface {
+	// BrokenZones lists zones that exist but have no valid version.
+	BrokenZones(ctx context.Context) ([]string, error)
+}
+
+// InternalTransfer copies zone to another storage, unless it already has
+// the same version of the zone.
 func InternalTransfer(ctx context.Context, zone Zone, to ZoneStorage) error {
-	err := to.Clear(ctx, zone.Name)
+	current, err := to.IsCurrent(ctx, &zone)
 	if err != nil {
-		return fmt.Errorf("failed to clear transfer target: %v", err)
+		return fmt.Errorf("failed to check zone version: %v", err)
 	}
-	for _, record := range zone.Records {
-		err = to.Patch(ctx, zone.Name, record)
-		if err != nil {
-			return fmt.Errorf("failed to transfer record: %v", err)
-		}
+	if current {
+		return nil
+	}
+	err = to.Replace(ctx, zone)
+	if err != nil {
+		return fmt.Errorf("failed to transfer zone: %v", err)
 	}
 	return nil
 }
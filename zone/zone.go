@@ -1,7 +1,14 @@
 package zone
 
+import "time"
+
 type Zone struct {
 	Name        string
 	Records     []DnsRecord
 	UpdatedHash string
+	Config      ZoneConfig
+
+	// When zone data was copied from primary storage; only known for
+	// zones loaded from fallback storage
+	SyncedAt time.Time
 }
@@ -0,0 +1,95 @@
+package zone
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Default TTL of exported zones that have no records
+const defaultExportTtl = 3600
+
+// relativeName converts owner name of a stored record to the form used in
+// zone files with $ORIGIN set to the zone.
+func relativeName(name string) string {
+	if name == "." {
+		return "@"
+	}
+	return strings.TrimSuffix(name, ".")
+}
+
+// WriteZoneFile writes records of zone as a RFC 1035 master file. Record
+// options that cannot be expressed in master files are left out.
+func WriteZoneFile(w io.Writer, origin string, records []DnsRecord) error {
+	// Most common TTL is used as default
+	ttls := make(map[uint32]int)
+	ttl := uint32(defaultExportTtl)
+	for _, record := range records {
+		recordTtl := record.Record.Header().Ttl
+		ttls[recordTtl]++
+		if ttls[recordTtl] > ttls[ttl] {
+			ttl = recordTtl
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "$ORIGIN %s\n$TTL %d\n", dns.Fqdn(origin), ttl)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		rr := dns.Copy(record.Record)
+		rr.Header().Name = relativeName(rr.Header().Name)
+		_, err = fmt.Fprintln(w, rr.String())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zoneFileId creates a record id that is the same whenever the same record
+// is read from a zone file, regardless of its TTL.
+func zoneFileId(rr dns.RR) string {
+	header := rr.Header()
+	ttl := header.Ttl
+	header.Ttl = 0
+	hash := sha256.Sum256([]byte(rr.String()))
+	header.Ttl = ttl
+	return fmt.Sprintf("%s-%s-%s", relativeName(header.Name), dns.TypeToString[header.Rrtype], hex.EncodeToString(hash[:4]))
+}
+
+// ParseZoneFile parses a RFC 1035 master file of zone. Owner names are
+// made relative to the zone, as names of records added through the API
+// are. Records get ids derived from their content, so duplicates are removed.
+func ParseZoneFile(r io.Reader, origin string) ([]DnsRecord, error) {
+	origin = dns.Fqdn(origin)
+	parser := dns.NewZoneParser(r, origin, "")
+	records := make([]DnsRecord, 0)
+	indices := make(map[string]int)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		header := rr.Header()
+		if header.Name == origin {
+			header.Name = "."
+		} else if dns.IsSubDomain(origin, header.Name) {
+			header.Name = strings.TrimSuffix(header.Name, origin)
+		} else {
+			return nil, fmt.Errorf("record %s is outside of zone %s", header.Name, origin)
+		}
+		record := DnsRecord{Id: zoneFileId(rr), Record: rr}
+		if i, ok := indices[record.Id]; ok {
+			records[i] = record // Later duplicate wins
+		} else {
+			indices[record.Id] = len(records)
+			records = append(records, record)
+		}
+	}
+	err := parser.Err()
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}